@@ -0,0 +1,243 @@
+package depot
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ACLConfig is the policy of the destinations which local may connect for
+// server, e.g.
+//
+//	"acl": {
+//	    "default": "deny",
+//	    "rules": [
+//	        {"action": "deny", "cidr": "192.168.1.1/32"},
+//	        {"action": "allow", "cidr": "192.168.1.0/24", "ports": "22,80,8000-8100"},
+//	        {"action": "allow", "domain": "*.example.com", "ports": "443"},
+//	        {"action": "allow", "host": "nas.lan"}
+//	    ]
+//	}
+//
+// The first matching rule decides, and default applies if none matches. To
+// allow all destinations, configure {"default": "allow"} without rules.
+type ACLConfig struct {
+	Default string    `json:"default"` // "allow" or "deny", deny if empty
+	Rules   []ACLRule `json:"rules"`
+}
+
+// ACLRule matches the destination by at most one of Host, CIDR and Domain,
+// and by Ports. Empty fields match everything.
+type ACLRule struct {
+	Action string `json:"action"` // "allow" or "deny"
+	Host   string `json:"host"`   // host name or ip address
+	CIDR   string `json:"cidr"`   // e.g. "10.0.0.0/8"
+	Domain string `json:"domain"` // e.g. "*.example.com" or "example.com"
+	Ports  string `json:"ports"`  // e.g. "22,80,8000-8100"
+}
+
+// ErrNotAllowed is the error of destinations denied by the ACL.
+var ErrNotAllowed = errors.New("not allowed by ruleset")
+
+type portRange struct {
+	min, max int
+}
+
+// PortRanges is a set of ports like "22,80,8000-8100".
+type PortRanges []portRange
+
+type aclRule struct {
+	allow  bool
+	host   string
+	ipnet  *net.IPNet
+	domain string
+	ports  PortRanges
+}
+
+// ACL is the compiled ACLConfig. A nil ACL denies everything.
+type ACL struct {
+	allow bool // default action
+	rules []aclRule
+}
+
+func parseAction(action string) (bool, error) {
+	switch strings.ToLower(action) {
+	case "allow":
+		return true, nil
+	case "deny", "":
+		return false, nil
+	default:
+		return false, fmt.Errorf("acl: invalid action %q", action)
+	}
+}
+
+// ParsePorts parses the port ranges separated by comma.
+func ParsePorts(s string) (PortRanges, error) {
+	var ports PortRanges
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		lo, hi := f, f
+		if i := strings.Index(f, "-"); i >= 0 {
+			lo, hi = f[:i], f[i+1:]
+		}
+		from, err1 := strconv.Atoi(strings.TrimSpace(lo))
+		to, err2 := strconv.Atoi(strings.TrimSpace(hi))
+		if err1 != nil || err2 != nil || from < 0 || to > 0xffff || from > to {
+			return nil, fmt.Errorf("invalid ports %q", f)
+		}
+		ports = append(ports, portRange{from, to})
+	}
+	return ports, nil
+}
+
+// NewACL compiles the configuration, nil config means no ACL, which denies
+// everything.
+func NewACL(c *ACLConfig) (*ACL, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	var err error
+	acl := new(ACL)
+	if acl.allow, err = parseAction(c.Default); err != nil {
+		return nil, err
+	}
+	for i, r := range c.Rules {
+		var rule aclRule
+		if r.Action == "" {
+			return nil, fmt.Errorf("acl: rule %d has no action", i)
+		}
+		if rule.allow, err = parseAction(r.Action); err != nil {
+			return nil, err
+		}
+		n := 0
+		if r.Host != "" {
+			rule.host = strings.ToLower(r.Host)
+			n++
+		}
+		if r.CIDR != "" {
+			if _, rule.ipnet, err = net.ParseCIDR(r.CIDR); err != nil {
+				return nil, fmt.Errorf("acl: rule %d: %v", i, err)
+			}
+			n++
+		}
+		if r.Domain != "" {
+			rule.domain = strings.ToLower(r.Domain)
+			n++
+		}
+		if n > 1 {
+			return nil, fmt.Errorf("acl: rule %d has more than one of host, cidr and domain", i)
+		}
+		if rule.ports, err = ParsePorts(r.Ports); err != nil {
+			return nil, fmt.Errorf("acl: rule %d: %v", i, err)
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+	return acl, nil
+}
+
+// matchDomain matches name with pattern, "*.example.com" matches all the
+// sub-domains of example.com but not itself.
+func matchDomain(pattern, name string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(name, pattern[1:])
+	}
+	return name == pattern
+}
+
+func (r *aclRule) match(name string, ip net.IP, port int) bool {
+	switch {
+	case r.host != "":
+		if r.host != name && !(ip != nil && r.host == ip.String()) {
+			return false
+		}
+	case r.ipnet != nil:
+		if ip == nil || !r.ipnet.Contains(ip) {
+			return false
+		}
+	case r.domain != "":
+		if name == "" || !matchDomain(r.domain, name) {
+			return false
+		}
+	}
+
+	return len(r.ports) == 0 || r.ports.Contains(port)
+}
+
+func (ports PortRanges) Contains(port int) bool {
+	for _, p := range ports {
+		if port >= p.min && port <= p.max {
+			return true
+		}
+	}
+	return false
+}
+
+// Check resolves the address of the request and checks it. It returns the
+// address to connect, which is the resolved ip so that the name can't
+// resolve to another ip later. A nil ACL denies everything without resolving.
+func (acl *ACL) Check(addrReq *AddrReq) (string, error) {
+	if acl == nil {
+		return "", ErrNotAllowed
+	}
+
+	port, _ := strconv.Atoi(addrReq.Port)
+	name := ""
+	ip := net.ParseIP(addrReq.Host)
+	if ip == nil {
+		name = addrReq.Host
+		ips, err := net.LookupIP(name)
+		if err != nil {
+			return "", err
+		}
+		ip = ips[0]
+	}
+	if !acl.Allow(name, ip, port) {
+		return "", ErrNotAllowed
+	}
+	return net.JoinHostPort(ip.String(), addrReq.Port), nil
+}
+
+// AllowUnresolved checks the domain name without resolving it, for server,
+// which can't resolve the names in the network of agents. The name may
+// resolve into the ip or CIDR of a rule, so such a deny rule denies it and
+// such an allow rule doesn't allow it.
+func (acl *ACL) AllowUnresolved(name string, port int) bool {
+	if acl == nil {
+		return false
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for i := range acl.rules {
+		r := &acl.rules[i]
+		if r.ipnet != nil || (r.host != "" && net.ParseIP(r.host) != nil) {
+			if !r.allow && (len(r.ports) == 0 || r.ports.Contains(port)) {
+				return false
+			}
+			continue
+		}
+		if r.match(name, nil, port) {
+			return r.allow
+		}
+	}
+	return acl.allow
+}
+
+// Allow checks the destination. name is the domain name of the request, empty
+// if it's an ip address, and ip is the address to connect.
+func (acl *ACL) Allow(name string, ip net.IP, port int) bool {
+	if acl == nil {
+		return false
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for i := range acl.rules {
+		if acl.rules[i].match(name, ip, port) {
+			return acl.rules[i].allow
+		}
+	}
+	return acl.allow
+}
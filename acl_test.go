@@ -0,0 +1,174 @@
+package depot
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		s    string
+		in   []int
+		out  []int
+		fail bool
+	}{
+		{s: "", out: []int{0, 80}},
+		{s: "22, 80,8000-8100", in: []int{22, 80, 8000, 8050, 8100},
+			out: []int{21, 81, 7999, 8101}},
+		{s: "0-65535", in: []int{0, 65535}},
+		{s: "8100-8000", fail: true},
+		{s: "65536", fail: true},
+		{s: "-1", fail: true},
+		{s: "http", fail: true},
+		{s: "80-", fail: true},
+	}
+	for _, tt := range tests {
+		ports, err := ParsePorts(tt.s)
+		if (err != nil) != tt.fail {
+			t.Errorf("ParsePorts(%q) error = %v", tt.s, err)
+			continue
+		}
+		for _, p := range tt.in {
+			if !ports.Contains(p) {
+				t.Errorf("ParsePorts(%q) doesn't contain %d", tt.s, p)
+			}
+		}
+		for _, p := range tt.out {
+			if ports.Contains(p) {
+				t.Errorf("ParsePorts(%q) contains %d", tt.s, p)
+			}
+		}
+	}
+}
+
+func TestNewACLInvalid(t *testing.T) {
+	tests := []*ACLConfig{
+		{Default: "maybe"},
+		{Rules: []ACLRule{{Host: "nas"}}},
+		{Rules: []ACLRule{{Action: "permit"}}},
+		{Rules: []ACLRule{{Action: "allow", CIDR: "10.0.0.0/33"}}},
+		{Rules: []ACLRule{{Action: "allow", Host: "nas", Domain: "lan"}}},
+		{Rules: []ACLRule{{Action: "allow", Ports: "1-0"}}},
+	}
+	for _, c := range tests {
+		if _, err := NewACL(c); err == nil {
+			t.Errorf("NewACL(%+v) = nil error", c)
+		}
+	}
+	if acl, err := NewACL(nil); acl != nil || err != nil {
+		t.Errorf("NewACL(nil) = %v, %v", acl, err)
+	}
+}
+
+var testACL = &ACLConfig{
+	Default: "deny",
+	Rules: []ACLRule{
+		{Action: "deny", CIDR: "192.168.1.1/32"},
+		{Action: "allow", CIDR: "192.168.1.0/24", Ports: "22,80,8000-8100"},
+		{Action: "allow", Domain: "*.example.com", Ports: "443"},
+		{Action: "allow", Host: "NAS.lan"},
+		{Action: "allow", Host: "10.0.0.1", Ports: "53"},
+	},
+}
+
+func TestACLAllow(t *testing.T) {
+	acl, err := NewACL(testACL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		ip    string
+		port  int
+		allow bool
+	}{
+		{"", "192.168.1.1", 22, false},
+		{"", "192.168.1.2", 22, true},
+		{"", "192.168.1.2", 8100, true},
+		{"", "192.168.1.2", 8101, false},
+		{"", "192.168.2.2", 22, false},
+		{"www.example.com", "1.2.3.4", 443, true},
+		{"a.b.example.com.", "1.2.3.4", 443, true},
+		{"example.com", "1.2.3.4", 443, false},
+		{"badexample.com", "1.2.3.4", 443, false},
+		{"www.example.com", "1.2.3.4", 80, false},
+		{"nas.LAN", "10.1.1.1", 5000, true},
+		{"", "10.0.0.1", 53, true},
+		{"", "10.0.0.1", 54, false},
+		// a name resolved into a denied ip is denied
+		{"evil.lan", "192.168.1.1", 22, false},
+	}
+	for _, tt := range tests {
+		if got := acl.Allow(tt.name, net.ParseIP(tt.ip), tt.port); got != tt.allow {
+			t.Errorf("Allow(%q, %s, %d) = %v, want %v", tt.name, tt.ip, tt.port,
+				got, tt.allow)
+		}
+	}
+
+}
+
+func TestACLDefault(t *testing.T) {
+	tests := []struct {
+		config *ACLConfig
+		allow  bool
+	}{
+		{nil, false},
+		{&ACLConfig{}, false},
+		{&ACLConfig{Default: "deny"}, false},
+		{&ACLConfig{Default: "allow"}, true},
+	}
+	req := &AddrReq{Host: "10.0.0.1", Port: "80"}
+	for _, tt := range tests {
+		acl, err := NewACL(tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := acl.Allow("nas", net.ParseIP("10.0.0.1"), 80); got != tt.allow {
+			t.Errorf("Allow() with %+v = %v, want %v", tt.config, got, tt.allow)
+		}
+		if got := acl.AllowUnresolved("nas", 80); got != tt.allow {
+			t.Errorf("AllowUnresolved() with %+v = %v, want %v", tt.config, got,
+				tt.allow)
+		}
+		if _, err := acl.Check(req); (err == nil) != tt.allow {
+			t.Errorf("Check() with %+v = %v, want allowed %v", tt.config, err,
+				tt.allow)
+		}
+	}
+}
+
+func TestACLAllowUnresolved(t *testing.T) {
+	tests := []struct {
+		config *ACLConfig
+		name   string
+		port   int
+		allow  bool
+	}{
+		// may resolve into 192.168.1.1, denied before any name rule
+		{testACL, "www.example.com", 443, false},
+		{testACL, "nas.lan", 22, false},
+		{&ACLConfig{Rules: testACL.Rules[2:]}, "www.example.com", 443, true},
+		{&ACLConfig{Rules: testACL.Rules[2:]}, "nas.lan", 22, true},
+		{&ACLConfig{Rules: testACL.Rules[2:]}, "other.lan", 22, false},
+		{&ACLConfig{Default: "allow", Rules: []ACLRule{
+			{Action: "deny", CIDR: "10.0.0.0/8"}}}, "intranet", 80, false},
+		{&ACLConfig{Default: "allow", Rules: []ACLRule{
+			{Action: "deny", Host: "10.0.0.1", Ports: "22"}}}, "intranet", 80, true},
+		{&ACLConfig{Default: "allow", Rules: []ACLRule{
+			{Action: "allow", Host: "intranet"},
+			{Action: "deny", CIDR: "10.0.0.0/8"}}}, "intranet", 80, true},
+		// allow rules of ip don't allow names
+		{&ACLConfig{Rules: []ACLRule{
+			{Action: "allow", CIDR: "0.0.0.0/0"}}}, "intranet", 80, false},
+	}
+	for _, tt := range tests {
+		acl, err := NewACL(tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := acl.AllowUnresolved(tt.name, tt.port); got != tt.allow {
+			t.Errorf("AllowUnresolved(%q, %d) with %+v = %v, want %v", tt.name,
+				tt.port, tt.config.Rules, got, tt.allow)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package depot
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Challenge/response authentication of the control connection with the
+// shared_key of both sides:
+//
+//  l->c: HELLO with local's nonce
+//  c->l: CHALLENGE with server's nonce
+//  l->c: AUTH with HMAC(key, "local", server nonce, local nonce, name)
+//  c->l: HELLO_ACK with HMAC(key, "server", local nonce, server nonce, name)
+//
+// A recorded AUTH is useless for another connection because server's nonce
+// is new each time, and server refuses local nonces it has seen recently.
+//
+// Tunnel connections of locals without multiplexing prove the key too:
+//
+//  l->c: TUNNEL with the session ID and HMAC(key, "tunnel", ID)
+//
+// Session IDs are random and used once, so a recorded TUNNEL is useless.
+
+const (
+	nonceLen = 32
+
+	AuthLocal  = "local"
+	AuthServer = "server"
+	AuthTunnel = "tunnel"
+)
+
+func NewNonce() []byte {
+	b := make([]byte, nonceLen)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// AuthMAC computes the proof of side, which is AuthLocal or AuthServer. The
+// nonce of the verifying side comes first.
+func AuthMAC(key, side string, nonce1, nonce2 []byte, name string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	for _, b := range [][]byte{[]byte(side), nonce1, nonce2, []byte(name)} {
+		var l [2]byte
+		l[0], l[1] = byte(len(b)>>8), byte(len(b))
+		mac.Write(l[:])
+		mac.Write(b)
+	}
+	return mac.Sum(nil)
+}
+
+// TunnelMAC computes the proof of local in TUNNEL for the session ID.
+func TunnelMAC(key string, id uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], id)
+	return AuthMAC(key, AuthTunnel, b[:], nil, "")
+}
+
+func CheckMAC(expected, got []byte) bool {
+	return hmac.Equal(expected, got)
+}
+
+// NonceCache remembers nonces for a while to detect replay.
+type NonceCache struct {
+	mu     sync.Mutex
+	window time.Duration
+	seen   map[string]time.Time
+}
+
+func NewNonceCache(window time.Duration) *NonceCache {
+	return &NonceCache{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Check returns false if the nonce is invalid or was seen in the window.
+func (c *NonceCache) Check(nonce []byte) bool {
+	if len(nonce) != nonceLen {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, t := range c.seen {
+		if now.Sub(t) > c.window {
+			delete(c.seen, k)
+		}
+	}
+	if _, ok := c.seen[string(nonce)]; ok {
+		return false
+	}
+	c.seen[string(nonce)] = now
+	return true
+}
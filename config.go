@@ -2,11 +2,57 @@ package depot
 
 import (
 	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/choueric/jconfig"
 )
 
+// AgentConfig tells server which socks sessions go to the agent.
+type AgentConfig struct {
+	Name      string   `json:"name"`
+	Users     []string `json:"users"`      // socks users
+	Domains   []string `json:"domains"`    // e.g. "*.home.depot"
+	SocksPort int      `json:"socks_port"` // extra socks port only for it
+}
+
+// ForwardConfig tunnels every connection on Port of server to Target, which is
+// connected by the agent.
+type ForwardConfig struct {
+	Port   int    `json:"port"`
+	Target string `json:"target"` // "host:port" in agent's network
+	Agent  string `json:"agent"`  // routed as socks requests if empty
+}
+
+// RateLimitConfig limits the bandwidth of sessions on server, in bytes per
+// second of each direction. 0 means no limit.
+type RateLimitConfig struct {
+	Global  int64            `json:"global"`  // all sessions
+	Session int64            `json:"session"` // each session
+	Users   map[string]int64 `json:"users"`   // sessions of each socks user
+	Agents  map[string]int64 `json:"agents"`  // sessions through each agent
+}
+
+// WebAdminConfig is the administrator who can change the settings on the web
+// port of server, by HTTP basic authentication.
+type WebAdminConfig struct {
+	User string `json:"user"`
+	Hash string `json:"hash"` // bcrypt hash, printed by `depot-server -hash`
+}
+
+// SessionLimitConfig caps the concurrent sessions on server, 0 means no
+// limit. Sessions over the caps wait in a queue if it's not full.
+type SessionLimitConfig struct {
+	Global       int `json:"global"`
+	User         int `json:"user"`          // sessions of each socks user
+	ClientIP     int `json:"client_ip"`     // sessions of each client ip
+	Agent        int `json:"agent"`         // sessions through each agent
+	Queue        int `json:"queue"`         // max waiting sessions, 0 to refuse at once
+	QueueTimeout int `json:"queue_timeout"` // seconds to wait, 5 if 0
+}
+
 type Config struct {
 	ServerAddr  string `json:"server_addr"`
 	ServerPort  int    `json:"server_port"`
@@ -17,6 +63,54 @@ type Config struct {
 	Password    string `json:"password"`
 	Timeout     int    `json:"timeout"` // unit: second
 	Debug       bool   `json:"debug"`
+	NoMux       bool   `json:"no_mux"` // local: use tunnel port, for old server
+	// server: accept locals without mux, and listen on tunnel port for them
+	AllowNoMux bool `json:"allow_no_mux"`
+	// server: reply success to socks client before local connects to app
+	OptimisticReply bool `json:"optimistic_reply"`
+	// server: agents and the default one for sessions not routed to others
+	Agents       []AgentConfig `json:"agents"`
+	DefaultAgent string        `json:"default_agent"`
+	// local: name to register on server
+	AgentName string `json:"agent_name"`
+	// TLS of control and tunnel connections, see tls.go
+	Plaintext bool     `json:"plaintext"`
+	TLSCert   string   `json:"tls_cert"` // certificate of this side
+	TLSKey    string   `json:"tls_key"`
+	TLSCA     string   `json:"tls_ca"`   // CA to verify the peer
+	TLSPins   []string `json:"tls_pins"` // SHA-256 of peer's certificate
+	// key to authenticate local on control connection, see auth.go
+	SharedKey string `json:"shared_key"`
+	// server: port of HTTP proxy, disabled if 0
+	HTTPPort int `json:"http_port"`
+	// server: static port forwards
+	Forwards []ForwardConfig `json:"forwards"`
+	// server: ports which locals can listen on, e.g. "19000-19100"
+	RemotePorts string `json:"remote_ports"`
+	// local: ports of server forwarded to local, agent is not used
+	RemoteForwards []ForwardConfig `json:"remote_forwards"`
+	// server: destinations for reverse socks of locals, disabled if absent
+	ReverseACL *ACLConfig `json:"reverse_acl"`
+	// local: address of reverse socks port, e.g. "0.0.0.0:1080"
+	ReverseSocks string `json:"reverse_socks"`
+	// server: file of socks users, see depot-server/users.go
+	UsersFile string `json:"users_file"`
+	// local: destinations allowed for server, see acl.go
+	ACL *ACLConfig `json:"acl"`
+	// server: bandwidth limits, adjustable on the web port
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	// server: who can change settings on the web port, read-only if absent
+	WebAdmin *WebAdminConfig `json:"web_admin"`
+	// server: caps of concurrent sessions
+	MaxSessions SessionLimitConfig `json:"max_sessions"`
+	// local: max concurrent tunnels, no limit if 0
+	MaxTunnels int `json:"max_tunnels"`
+	// seconds between heartbeats, 2 if 0
+	HeartbeatInterval int `json:"heartbeat_interval"`
+	// heartbeats missed in a row before the peer is dead, 3 if 0
+	HeartbeatMisses int `json:"heartbeat_misses"`
+	// seconds to wait for active sessions at shutdown, 30 if 0
+	DrainTimeout int `json:"drain_timeout"`
 	// internal
 	jc   interface{} // must be interface{}, otherwise panic
 	path string      // path of the configuration file
@@ -32,12 +126,18 @@ const (
 	"timeout": 600,
 	"user_name": "user",
 	"password": "password",
+	"plaintext": false,
+	"tls_cert": "",
+	"tls_key": "",
+	"tls_ca": "",
 	"debug": false
 } `
 	VERSION = "0.0.2"
 )
 
-var readTimeout time.Duration
+// readTimeout is the time.Duration of Timeout, changed by reload while pipes
+// read it.
+var readTimeout int64
 
 func GetDefaultConfigPath() string {
 	return os.Getenv("HOME") + "/.depot/config.json"
@@ -47,7 +147,7 @@ func GetDefaultConfigDir() string {
 	return os.Getenv("HOME") + "/.depot"
 }
 
-func GetConfig(filepath string) (*Config, error) {
+func loadConfig(filepath string) (*Config, error) {
 	jc := jconfig.New(filepath, Config{})
 
 	if _, err := jc.Load(defaultConfig); err != nil {
@@ -57,8 +157,78 @@ func GetConfig(filepath string) (*Config, error) {
 	config := jc.Data().(*Config)
 	config.jc = jc
 	config.path = jc.FilePath()
+	return config, nil
+}
 
-	readTimeout = time.Duration(config.Timeout) * time.Second
-
+func GetConfig(filepath string) (*Config, error) {
+	config, err := loadConfig(filepath)
+	if err != nil {
+		return nil, err
+	}
+	config.ApplyTimeout()
 	return config, nil
 }
+
+// ApplyTimeout sets the read timeout of connections to Timeout.
+func (c *Config) ApplyTimeout() {
+	atomic.StoreInt64(&readTimeout, int64(time.Duration(c.Timeout)*time.Second))
+}
+
+const defaultDrainTimeout = 30 * time.Second
+
+// HeartbeatDuration returns the interval of heartbeats.
+func (c *Config) HeartbeatDuration() time.Duration {
+	if c.HeartbeatInterval > 0 {
+		return time.Duration(c.HeartbeatInterval) * time.Second
+	}
+	return DefaultHeartbeatInterval
+}
+
+// MaxHeartbeatMisses returns how many heartbeats can be missed in a row.
+func (c *Config) MaxHeartbeatMisses() int {
+	if c.HeartbeatMisses > 0 {
+		return c.HeartbeatMisses
+	}
+	return DefaultHeartbeatMisses
+}
+
+// DrainDuration returns how long to wait for active sessions at shutdown.
+func (c *Config) DrainDuration() time.Duration {
+	if c.DrainTimeout > 0 {
+		return time.Duration(c.DrainTimeout) * time.Second
+	}
+	return defaultDrainTimeout
+}
+
+// Path returns the path of the configuration file.
+func (c *Config) Path() string {
+	return c.path
+}
+
+// Reload reads the configuration file of c again. The fields in fixed, by
+// their JSON names, can't change without restart. They keep the values of c
+// in the new configuration, and the names of those changed in the file are
+// returned.
+func (c *Config) Reload(fixed ...string) (*Config, []string, error) {
+	n, err := loadConfig(c.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var changed []string
+	ov, nv := reflect.ValueOf(c).Elem(), reflect.ValueOf(n).Elem()
+	t := ov.Type()
+	for _, name := range fixed {
+		for i := 0; i < t.NumField(); i++ {
+			tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if tag != name {
+				continue
+			}
+			if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+				changed = append(changed, name)
+				nv.Field(i).Set(ov.Field(i))
+			}
+		}
+	}
+	return n, changed, nil
+}
@@ -7,12 +7,6 @@ import (
 	"strconv"
 )
 
-const (
-	TunnelHelloMsg = "hello server"
-	TunnelReplyMsg = "hello local"
-	TunnelAliveMsg = "I'm alive"
-)
-
 //  address request from socks5
 //  +------+----------+----------+
 //  | ATYP | BND.ADDR | BND.PORT |
@@ -41,31 +35,39 @@ func (r *AddrReq) String() string {
 	return r.Address()
 }
 
+var errReqAddrLen = errors.New("invalid length of socksraw")
+
+// NewReqAddr parses the address request, which must have the exact length of
+// its atype. raw can come from the peer, so it's never trusted.
 func NewReqAddr(raw []byte) (*AddrReq, error) {
 	if len(raw) < 4 {
 		return nil, errors.New("socksraw too short")
 	}
 
 	parsePort := func(p []byte) string {
-		pp := int(binary.BigEndian.Uint16(p))
-		// fix transmission remote's endianess bug
-		if pp == 33571 || pp == 50111 { // 33571=0x8323, 0x2383=9091
-			pp = int(binary.LittleEndian.Uint16(p))
-		}
-		return strconv.Itoa(pp)
+		return strconv.Itoa(int(binary.BigEndian.Uint16(p)))
 	}
 
 	var addrReq AddrReq
 	switch raw[0] {
 	case 0x01:
+		if len(raw) != 1+net.IPv4len+2 {
+			return nil, errReqAddrLen
+		}
 		addrReq.Atype = int(raw[0])
 		addrReq.Host = net.IP(raw[1 : 1+net.IPv4len]).String()
 		addrReq.Port = parsePort(raw[1+net.IPv4len:])
 	case 0x04:
+		if len(raw) != 1+net.IPv6len+2 {
+			return nil, errReqAddrLen
+		}
 		addrReq.Atype = int(raw[0])
 		addrReq.Host = net.IP(raw[1 : 1+net.IPv6len]).String()
 		addrReq.Port = parsePort(raw[1+net.IPv6len:])
 	case 0x03:
+		if len(raw) != 2+int(raw[1])+2 {
+			return nil, errReqAddrLen
+		}
 		addrReq.Atype = int(raw[0])
 		addrReq.Host = string(raw[2 : 2+raw[1]])
 		addrReq.Port = parsePort(raw[2+raw[1]:])
@@ -77,3 +79,36 @@ func NewReqAddr(raw []byte) (*AddrReq, error) {
 
 	return &addrReq, nil
 }
+
+// NewAddrReqFromAddr creates the request of "host:port".
+func NewAddrReqFromAddr(address string) (*AddrReq, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid port " + port)
+	}
+
+	var raw []byte
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && ip.To4() != nil:
+		raw = append([]byte{0x01}, ip.To4()...)
+	case ip != nil:
+		raw = append([]byte{0x04}, ip.To16()...)
+	case len(host) > 0 && len(host) <= 255:
+		raw = append([]byte{0x03, byte(len(host))}, host...)
+	default:
+		return nil, errors.New("invalid host " + host)
+	}
+	raw = append(raw, byte(p>>8), byte(p))
+
+	return &AddrReq{
+		Atype: int(raw[0]),
+		Host:  host,
+		Port:  strconv.Itoa(int(p)),
+		Raw:   raw,
+	}, nil
+}
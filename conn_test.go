@@ -0,0 +1,61 @@
+package depot
+
+import "testing"
+
+func TestNewReqAddrMalformed(t *testing.T) {
+	tests := [][]byte{
+		{},
+		{0x01, 0, 0},
+		{0x01, 0, 0, 0, 0},
+		{0x01, 127, 0, 0, 1, 0, 80, 0},
+		{0x04, 0, 0, 0, 0, 0, 0},
+		{0x03, 5, 'a', 'b'},
+		{0x03, 1, 'a', 0, 80, 0},
+		{0x05, 0, 0, 0, 0, 0, 0},
+	}
+	for _, raw := range tests {
+		if _, err := NewReqAddr(raw); err == nil {
+			t.Errorf("NewReqAddr(%v) = nil error", raw)
+		}
+	}
+}
+
+func TestNewReqAddr(t *testing.T) {
+	tests := []struct {
+		raw  []byte
+		addr string
+	}{
+		{[]byte{0x01, 127, 0, 0, 1, 0, 80}, "127.0.0.1:80"},
+		{[]byte{0x03, 3, 'n', 'a', 's', 0x1f, 0x90}, "nas:8080"},
+		{append(append([]byte{0x04}, make([]byte, 15)...), 1, 0x01, 0xbb),
+			"[::1]:443"},
+	}
+	for _, tt := range tests {
+		r, err := NewReqAddr(tt.raw)
+		if err != nil {
+			t.Errorf("NewReqAddr(%v): %v", tt.raw, err)
+			continue
+		}
+		if r.Address() != tt.addr {
+			t.Errorf("NewReqAddr(%v) = %s, want %s", tt.raw, r.Address(), tt.addr)
+		}
+	}
+}
+
+func TestAddrReqRoundTrip(t *testing.T) {
+	for _, addr := range []string{"nas:33571", "10.0.0.1:50111", "[::1]:9091"} {
+		r, err := NewAddrReqFromAddr(addr)
+		if err != nil {
+			t.Errorf("NewAddrReqFromAddr(%s): %v", addr, err)
+			continue
+		}
+		got, err := NewReqAddr(r.Raw)
+		if err != nil {
+			t.Errorf("NewReqAddr of %s: %v", addr, err)
+			continue
+		}
+		if got.Address() != addr {
+			t.Errorf("round trip of %s = %s", addr, got.Address())
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+)
+
+const bindAcceptTimeout = 2 * time.Minute
+
+// bindAddr returns the address of the listener as seen by the peer, which is
+// the ip of the interface routing to the peer instead of 0.0.0.0.
+func bindAddr(ln net.Listener, peer *depot.AddrReq) (*depot.AddrReq, error) {
+	port := ln.Addr().(*net.TCPAddr).Port
+	ip := net.IPv4zero
+	// no packet is sent by connecting an UDP socket
+	if c, err := net.Dial("udp", peer.Address()); err == nil {
+		ip = c.LocalAddr().(*net.UDPAddr).IP
+		c.Close()
+	}
+	return depot.NewAddrReqFromAddr((&net.TCPAddr{IP: ip, Port: port}).String())
+}
+
+// acceptPeer listens for the peer of BIND and reports the listening address
+// to server, then the address of the peer when it connects, and pipes the
+// peer with the tunnel. Only the peer in the request is accepted if it's an
+// ip address.
+func acceptPeer(tunnelConn net.Conn, addrReq *depot.AddrReq,
+	result *depot.OpenResult) error {
+	if _, err := checkACL(addrReq); err != nil {
+		return replyError(tunnelConn, result, depot.DialErrorRep(err), err)
+	}
+
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return replyError(tunnelConn, result, depot.RepGeneralFailure, err)
+	}
+	defer ln.Close()
+
+	bind, err := bindAddr(ln, addrReq)
+	if err != nil {
+		return replyError(tunnelConn, result, depot.RepGeneralFailure, err)
+	}
+	result.Bind = bind.Raw
+	if err = depot.WriteMsg(tunnelConn, depot.MsgOpenResult, result); err != nil {
+		tunnelConn.Close()
+		return err
+	}
+	dbgLog.Println("bind at", bind, "for", addrReq)
+
+	expected := net.ParseIP(addrReq.Host)
+	if expected != nil && expected.IsUnspecified() {
+		expected = nil
+	}
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(bindAcceptTimeout))
+	var peerConn net.Conn
+	for {
+		if peerConn, err = ln.Accept(); err != nil {
+			clog.Error("accept bind peer for", addrReq, "error:", err)
+			return replyError(tunnelConn, result, depot.DialErrorRep(err), err)
+		}
+		ip := peerConn.RemoteAddr().(*net.TCPAddr).IP
+		if expected == nil || expected.Equal(ip) {
+			break
+		}
+		dbgLog.Println("refuse bind peer", peerConn.RemoteAddr())
+		peerConn.Close()
+	}
+	ln.Close()
+
+	peer, err := depot.NewAddrReqFromAddr(peerConn.RemoteAddr().String())
+	if err != nil {
+		peerConn.Close()
+		return replyError(tunnelConn, result, depot.RepGeneralFailure,
+			errors.New("invalid peer address"))
+	}
+	result.Bind = peer.Raw
+	if err = depot.WriteMsg(tunnelConn, depot.MsgOpenResult, result); err != nil {
+		peerConn.Close()
+		tunnelConn.Close()
+		return err
+	}
+
+	go depot.PipeThenClose(tunnelConn, peerConn)
+	depot.PipeThenClose(peerConn, tunnelConn)
+	dbgLog.Println("closed bind connection from", peer)
+	return nil
+}
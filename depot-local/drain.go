@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+)
+
+// On SIGTERM or SIGINT, local closes the reverse socks port, refuses new open
+// requests, and tells server by SHUTDOWN so no new sessions are routed to it.
+// The active tunnels and reverse socks connections have drain_timeout to
+// finish, then local closes the control connection with CLOSE and exits.
+
+var errShuttingDown = errors.New("local is shutting down")
+
+var (
+	shuttingDown int32 // accessed atomically
+
+	controlMu  sync.Mutex
+	controlNow net.Conn // control connection to server, nil if not connected
+)
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) != 0
+}
+
+func setControl(c net.Conn) {
+	controlMu.Lock()
+	controlNow = c
+	controlMu.Unlock()
+}
+
+func getControl() net.Conn {
+	controlMu.Lock()
+	defer controlMu.Unlock()
+	return controlNow
+}
+
+// numActive returns the number of tunnels and reverse socks connections.
+func numActive() int {
+	return int(atomic.LoadInt32(&numTunnels) + atomic.LoadInt32(&numReverse))
+}
+
+func exitOnSignal(sigChan <-chan os.Signal) {
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			clog.Warn("caught signal", sig, "again, exit")
+			os.Exit(1)
+		}
+	}
+}
+
+func shutdown() {
+	atomic.StoreInt32(&shuttingDown, 1)
+	start := time.Now()
+	drain := getConfig().DrainDuration()
+	closeReverse()
+
+	ctrl := getControl()
+	if ctrl != nil {
+		sd := depot.Shutdown{Drain: int(drain / time.Second)}
+		if err := depot.WriteMsg(ctrl, depot.MsgShutdown, &sd); err != nil {
+			clog.Error("shutdown:", err)
+		}
+	}
+
+	n := numActive()
+	clog.Printf("shutdown: drain %d tunnels in %v\n", n, drain)
+	deadline := time.Now().Add(drain)
+	for numActive() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	left := numActive()
+
+	if ctrl = getControl(); ctrl != nil {
+		depot.WriteMsg(ctrl, depot.MsgClose, &depot.Close{Reason: "local shutdown"})
+	}
+	clog.Printf("shutdown: %d tunnels at shutdown, %d closed at drain timeout, "+
+		"in %v\n", n, left, time.Since(start).Round(time.Millisecond))
+}
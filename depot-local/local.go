@@ -1,14 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
-	"io"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -16,119 +18,398 @@ import (
 	"github.com/choueric/depot"
 )
 
+const appDialTimeout = 10 * time.Second
+
 var (
 	debug      = true
 	dbgLog     = depot.SetDebug(debug)
 	configFile = depot.GetDefaultConfigPath()
+	tlsConfig  *tls.Config // nil if plaintext
+	forwards   []depot.Forward
+	maxTunnels int32 // no limit if 0, accessed atomically
+	numTunnels int32 // accessed atomically
 )
 
+var errTooManyTunnels = errors.New("too many tunnels")
+
 func waitSignal() {
 	var sigChan = make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGHUP)
+	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
 	for sig := range sigChan {
 		if sig == syscall.SIGHUP {
-			// TODO: update configurations
+			if err := reloadConfig(); err != nil {
+				clog.Error("reload configuration, keep the old one:", err)
+			}
 		} else {
-			// is this going to happen?
-			log.Printf("caught signal %v, exit", sig)
-			os.Exit(0)
+			log.Printf("caught signal %v, shut down", sig)
+			go exitOnSignal(sigChan)
+			shutdown()
+			return
 		}
 	}
 }
 
-func handShake(server net.Conn) error {
-	_, err := server.Write([]byte(depot.TunnelHelloMsg))
-	if err != nil {
-		return err
+// handShake sends hello to server and returns server's hello, whose
+// capabilities tell if all tunnels are multiplexed over the control
+// connection. With the shared key, local and server authenticate each other.
+func handShake(server net.Conn, name, key string, mux bool) (*depot.Hello, error) {
+	hello := depot.Hello{
+		Version: depot.ProtoVersion,
+		Name:    name,
+		Nonce:   depot.NewNonce(),
+	}
+	if mux {
+		hello.Caps = append(hello.Caps, depot.CapMux)
+	}
+	if key != "" {
+		hello.Caps = append(hello.Caps, depot.CapAuth)
+	}
+	hello.Caps = append(hello.Caps, depot.CapHeartbeat)
+	if err := depot.WriteMsg(server, depot.MsgHello, &hello); err != nil {
+		return nil, err
 	}
 
-	buf := make([]byte, 128)
-	n, err := server.Read(buf)
+	msg, err := depot.ReadMsg(server)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if n != len(depot.TunnelReplyMsg) && string(buf) != depot.TunnelReplyMsg {
-		dbgLog.Printf("receiv handShake msg: %s\n", string(buf))
-		return errors.New("invalid tunnel hello msg")
+	var nonce []byte
+	if msg.Type == depot.MsgChallenge {
+		if nonce, err = answerChallenge(server, msg, &hello, key); err != nil {
+			return nil, err
+		}
+		if msg, err = depot.ReadMsg(server); err != nil {
+			return nil, err
+		}
 	}
 
-	return nil
+	var ack depot.Hello
+	switch msg.Type {
+	case depot.MsgHelloAck:
+		if err = msg.Decode(&ack); err != nil {
+			return nil, err
+		}
+	case depot.MsgError:
+		var e depot.Error
+		if err = msg.Decode(&e); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("server refused: " + e.Reason)
+	default:
+		return nil, errors.New("unexpected " + depot.MsgName(msg.Type))
+	}
+	dbgLog.Println("server hello:", ack.Version, ack.Caps)
+
+	if ack.Version != depot.ProtoVersion {
+		return nil, fmt.Errorf("server protocol version %d is not supported",
+			ack.Version)
+	}
+	if key != "" {
+		if nonce == nil {
+			return nil, errors.New("auth: server did not authenticate")
+		}
+		mac := depot.AuthMAC(key, depot.AuthServer, hello.Nonce, nonce, name)
+		if !depot.CheckMAC(mac, ack.Proof) {
+			return nil, errors.New("auth: server has wrong shared key")
+		}
+	}
+
+	return &ack, nil
 }
 
-func getRequest(ctrlConn net.Conn) (*depot.AddrReq, error) {
-	buf := make([]byte, 256)
-	n, err := ctrlConn.Read(buf)
-	if err != nil {
+// answerChallenge proves to server that local knows the shared key, and
+// returns server's nonce.
+func answerChallenge(server net.Conn, msg *depot.Msg, hello *depot.Hello,
+	key string) ([]byte, error) {
+	if key == "" {
+		err := errors.New("auth: no shared_key configured")
+		depot.WriteMsg(server, depot.MsgError, &depot.Error{Reason: err.Error()})
 		return nil, err
 	}
-	dbgLog.Println("receive socksraw:", buf[0:n])
 
-	addrReq, err := depot.NewReqAddr(buf[0:n])
-	if err != nil {
+	var challenge depot.Challenge
+	if err := msg.Decode(&challenge); err != nil {
 		return nil, err
 	}
-	dbgLog.Println("socks request:", addrReq)
+	mac := depot.AuthMAC(key, depot.AuthLocal, challenge.Nonce, hello.Nonce,
+		hello.Name)
+	if err := depot.WriteMsg(server, depot.MsgAuth, &depot.Auth{MAC: mac}); err != nil {
+		return nil, err
+	}
+	return challenge.Nonce, nil
+}
 
-	return addrReq, nil
+// handleControl reads messages from server until the control connection is
+// down or closed by server. Open requests are passed to onOpen, and PONGs to
+// beat.
+func handleControl(ctrlConn net.Conn, beat *depot.Heartbeat,
+	onOpen func(*depot.Open)) error {
+	for {
+		msg, err := depot.ReadMsg(ctrlConn)
+		if err != nil {
+			return err
+		}
+
+		switch msg.Type {
+		case depot.MsgOpen:
+			if onOpen == nil {
+				return errors.New("unexpected open request on control")
+			}
+			open := new(depot.Open)
+			if err := msg.Decode(open); err != nil {
+				return err
+			}
+			dbgLog.Println("open request:", open.ID)
+			onOpen(open)
+		case depot.MsgPing:
+			var ping depot.Ping
+			if err := msg.Decode(&ping); err != nil {
+				return err
+			}
+			if err := depot.WriteMsg(ctrlConn, depot.MsgPong, &ping); err != nil {
+				return err
+			}
+		case depot.MsgPong:
+			var pong depot.Ping
+			if err := msg.Decode(&pong); err != nil {
+				return err
+			}
+			beat.Pong(&pong)
+		case depot.MsgShutdown:
+			var sd depot.Shutdown
+			if err := msg.Decode(&sd); err != nil {
+				return err
+			}
+			clog.Printf("server is shutting down, drain %d seconds\n", sd.Drain)
+		case depot.MsgForwardResult:
+			var r depot.ForwardResult
+			if err := msg.Decode(&r); err != nil {
+				return err
+			}
+			if r.Error != "" {
+				clog.Error("remote forward of server port", r.Port, "error:", r.Error)
+			} else {
+				clog.Printf("server port %d is forwarded\n", r.Port)
+			}
+		case depot.MsgClose:
+			var c depot.Close
+			if err := msg.Decode(&c); err != nil {
+				return err
+			}
+			if c.ID == 0 {
+				return errors.New("closed by server: " + c.Reason)
+			}
+			dbgLog.Println("server closed session", c.ID, c.Reason)
+		case depot.MsgError:
+			var e depot.Error
+			if err := msg.Decode(&e); err != nil {
+				return err
+			}
+			return errors.New("server error: " + e.Reason)
+		default:
+			dbgLog.Println("ignore control message", msg)
+		}
+	}
 }
 
-func handleRequest(addrReq *depot.AddrReq, server, port string) error {
+func handleRequest(open *depot.Open, server, port string) error {
 	addr := net.JoinHostPort(server, port)
-	tunnelConn, err := net.Dial("tcp", addr)
+	tunnelConn, err := depot.Dial(addr, tlsConfig)
 	if err != nil {
-		clog.Error("dial tunnel %v error: %v\n", addr, err)
+		clog.Error("dial tunnel", addr, "error:", err)
 		return err
 	}
 
-	closed := false
-	defer func() {
-		if !closed {
-			tunnelConn.Close()
-		}
-	}()
-
-	dbgLog.Println("send tunnel handshake:", addrReq.Raw)
-	_, err = tunnelConn.Write(addrReq.Raw)
+	dbgLog.Println("send tunnel handshake:", open.ID)
+	tunnel := depot.Tunnel{ID: open.ID}
+	if key := getConfig().SharedKey; key != "" {
+		tunnel.MAC = depot.TunnelMAC(key, open.ID)
+	}
+	err = depot.WriteMsg(tunnelConn, depot.MsgTunnel, &tunnel)
 	if err != nil {
+		tunnelConn.Close()
+		return err
+	}
+
+	return handleOpen(tunnelConn, open)
+}
+
+func handleStream(stream *depot.Stream) error {
+	open := new(depot.Open)
+	if err := depot.ExpectMsg(stream, depot.MsgOpen, open); err != nil {
+		stream.Close()
 		return err
 	}
+	dbgLog.Println("stream", stream.ID(), "open request:", open.ID)
 
-	appConn, err := net.Dial("tcp", addrReq.Address())
+	return handleOpen(stream, open)
+}
+
+// handleOpen serves the open request on the tunnel. tunnelConn is closed
+// when it returns.
+func handleOpen(tunnelConn net.Conn, open *depot.Open) error {
+	result := depot.OpenResult{ID: open.ID}
+	n := atomic.AddInt32(&numTunnels, 1)
+	defer atomic.AddInt32(&numTunnels, -1)
+	if max := atomic.LoadInt32(&maxTunnels); max > 0 && n > max {
+		clog.Warn("refuse open request", open.ID, "-", errTooManyTunnels)
+		return replyError(tunnelConn, &result, depot.RepGeneralFailure,
+			errTooManyTunnels)
+	}
+	if isShuttingDown() {
+		return replyError(tunnelConn, &result, depot.RepGeneralFailure,
+			errShuttingDown)
+	}
+
+	addrReq, err := depot.NewReqAddr(open.Addr)
 	if err != nil {
-		clog.Error("dial app %v error: \n", addrReq, err)
+		return replyError(tunnelConn, &result, depot.RepAddrTypeUnsupported, err)
+	}
+	dbgLog.Println("request address:", addrReq)
+
+	switch open.Cmd {
+	case depot.CmdConnect:
+		return pipeApp(tunnelConn, addrReq, &result)
+	case depot.CmdBind:
+		return acceptPeer(tunnelConn, addrReq, &result)
+	case depot.CmdUDP:
+		return relayUDP(tunnelConn, &result)
+	default:
+		return replyError(tunnelConn, &result, depot.RepCmdNotSupported,
+			fmt.Errorf("command %d not supported", open.Cmd))
+	}
+}
+
+// checkACL checks the address of the request with the ACL, and returns the
+// address to connect.
+func checkACL(addrReq *depot.AddrReq) (string, error) {
+	addr, err := getACL().Check(addrReq)
+	if err == depot.ErrNotAllowed {
+		clog.Warn("deny", addrReq, "by acl")
+	}
+	return addr, err
+}
+
+// pipeApp connects to the app, reports the result to server and pipes the
+// app with the tunnel.
+func pipeApp(tunnelConn net.Conn, addrReq *depot.AddrReq,
+	result *depot.OpenResult) error {
+	addr, err := checkACL(addrReq)
+	if err != nil {
+		return replyError(tunnelConn, result, depot.DialErrorRep(err), err)
+	}
+	appConn, err := net.DialTimeout("tcp", addr, appDialTimeout)
+	if err != nil {
+		clog.Error("dial app", addrReq, "error:", err)
+		return replyError(tunnelConn, result, depot.DialErrorRep(err), err)
+	}
+	if bind, err := depot.NewAddrReqFromAddr(appConn.LocalAddr().String()); err == nil {
+		result.Bind = bind.Raw
+	}
+	if err = depot.WriteMsg(tunnelConn, depot.MsgOpenResult, result); err != nil {
+		appConn.Close()
+		tunnelConn.Close()
 		return err
 	}
-	defer func() {
-		if !closed {
-			appConn.Close()
-		}
-	}()
 
 	go depot.PipeThenClose(tunnelConn, appConn)
 	depot.PipeThenClose(appConn, tunnelConn)
-	closed = true
 	dbgLog.Println("closed connection to", addrReq)
 	return nil
 }
 
-func sayAlive(ctrlConn net.Conn, done <-chan struct{}) {
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
+// replyError sends the failed result to server and closes the tunnel.
+func replyError(tunnelConn net.Conn, result *depot.OpenResult, rep byte,
+	err error) error {
+	result.Rep = rep
+	result.Error = err.Error()
+	depot.WriteMsg(tunnelConn, depot.MsgOpenResult, result)
+	tunnelConn.Close()
+	return err
+}
+
+// newForwards returns the forward requests of remote forwards.
+func newForwards(configs []depot.ForwardConfig) ([]depot.Forward, error) {
+	var list []depot.Forward
+	for _, fc := range configs {
+		target, err := depot.NewAddrReqFromAddr(fc.Target)
+		if err != nil {
+			return nil, fmt.Errorf("remote forward %d target: %v", fc.Port, err)
+		}
+		list = append(list, depot.Forward{Port: fc.Port, Addr: target.Raw})
+	}
+	return list, nil
+}
+
+// requestForwards asks server to listen on the ports of remote forwards.
+func requestForwards(ctrlConn net.Conn) error {
+	for i := range forwards {
+		if err := depot.WriteMsg(ctrlConn, depot.MsgForward, &forwards[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// heartbeatInterval and heartbeatMisses return the heartbeat settings,
+// which can be changed by reloading.
+func heartbeatInterval() time.Duration {
+	return getConfig().HeartbeatDuration()
+}
+
+func heartbeatMisses() int {
+	return getConfig().MaxHeartbeatMisses()
+}
+
+// sayAlive sends heartbeats to server until done is closed. If server misses
+// them, teardown is called to close the control connection.
+func sayAlive(ctrlConn net.Conn, beat *depot.Heartbeat, done <-chan struct{},
+	teardown func()) {
+	err := beat.Run(ctrlConn, heartbeatInterval, heartbeatMisses, done)
+	if err == depot.ErrPeerDead {
+		clog.Error("server is dead:", err)
+		teardown()
+	}
+}
+
+// serveSession multiplexes all tunnels over the control connection. Every
+// stream opened by server is a new tunnel. If server supports reverse socks,
+// the session is used by reverse socks clients too.
+func serveSession(ctrlConn net.Conn, reverse bool) {
+	session := depot.NewSession(ctrlConn, false)
+	if reverse {
+		setReverseSession(session)
+		defer setReverseSession(nil)
+	}
+	setControl(session.Control())
+	defer setControl(nil)
+	beat := new(depot.Heartbeat)
+	done := make(chan struct{})
+	go sayAlive(session.Control(), beat, done, func() { session.Close() })
+	requestForwards(session.Control())
+	go func() {
+		err := handleControl(session.Control(), beat, nil)
+		clog.Error("control connction error: ", err)
+		session.Close()
+	}()
+
 	for {
-		select {
-		case <-done:
-			return
-		case <-ticker.C:
-			ctrlConn.Write([]byte(depot.TunnelAliveMsg))
+		stream, err := session.Accept()
+		if err != nil { // control connction is down
+			break
 		}
+		go handleStream(stream)
 	}
+
+	session.Close()
+	close(done)
 }
 
-func run(server, ctrlPort, tunnelPort string) {
+func run(server, ctrlPort, tunnelPort, name, key string, mux bool) {
 	addr := net.JoinHostPort(server, ctrlPort)
-	for {
+	for !isShuttingDown() {
 		dbgLog.Printf("try to connect server ... ")
-		ctrlConn, err := net.Dial("tcp", addr)
+		ctrlConn, err := depot.Dial(addr, tlsConfig)
 		if err != nil {
 			dbgLog.Warn(err)
 			time.Sleep(2 * time.Second)
@@ -136,30 +417,32 @@ func run(server, ctrlPort, tunnelPort string) {
 		}
 		dbgLog.Printf("done via %v\n", ctrlConn.LocalAddr())
 
-		err = handShake(ctrlConn)
+		ack, err := handShake(ctrlConn, name, key, mux)
 		if err != nil {
 			clog.Error("error handshaking: ", err)
 			ctrlConn.Close()
+			time.Sleep(2 * time.Second)
 			continue
 		}
 
+		if ack.HasCap(depot.CapMux) {
+			serveSession(ctrlConn, ack.HasCap(depot.CapReverse))
+			continue
+		}
+
+		setControl(ctrlConn)
+		beat := new(depot.Heartbeat)
 		done := make(chan struct{})
-		go sayAlive(ctrlConn, done)
-
-		for {
-			req, err := getRequest(ctrlConn)
-			if err != nil { // control connction is down
-				clog.Error("control connction error: ", err)
-				if err == io.EOF {
-					ctrlConn.Close()
-					close(done)
-					break
-				}
-				continue
-			}
+		go sayAlive(ctrlConn, beat, done, func() { ctrlConn.Close() })
+		requestForwards(ctrlConn)
 
-			go handleRequest(req, server, tunnelPort)
-		}
+		err = handleControl(ctrlConn, beat, func(open *depot.Open) {
+			go handleRequest(open, server, tunnelPort)
+		})
+		clog.Error("control connction error: ", err)
+		setControl(nil)
+		ctrlConn.Close()
+		close(done)
 	}
 }
 
@@ -167,18 +450,41 @@ func init() {
 	clog.Printf("depot-local [%v]\n", depot.VERSION)
 	clog.SetFlags(clog.Ldate | clog.Ltime | clog.Lshortfile | clog.Lcolor)
 	flag.StringVar(&configFile, "c", configFile, "specify config file")
-	flag.Parse()
 }
 
 func main() {
+	flag.Parse()
 	config, err := depot.GetConfig(configFile)
 	if err != nil {
 		dbgLog.Fatal("get configuration error: %v\n", err)
 	}
 
-	dbgLog = depot.SetDebug(config.Debug)
+	depot.SetDebug(config.Debug)
 
+	if tlsConfig, err = config.ClientTLSConfig(); err != nil {
+		clog.Fatal("tls:", err)
+	}
+	maxTunnels = int32(config.MaxTunnels)
+	s := &settings{config: config}
+	if s.acl, err = depot.NewACL(config.ACL); err != nil {
+		clog.Fatal(err)
+	}
+	if s.acl == nil {
+		clog.Warn(`no acl configured, all destinations are denied, set "acl": {"default": "allow"} to allow them`)
+	}
+	if forwards, err = newForwards(config.RemoteForwards); err != nil {
+		clog.Fatal(err)
+	}
+	current.Store(s)
+
+	name := config.AgentName
+	if name == "" {
+		name = depot.DefaultAgentName
+	}
+	if config.ReverseSocks != "" {
+		go serveReverse(config.ReverseSocks)
+	}
 	go run(config.ServerAddr, strconv.Itoa(config.ControlPort),
-		strconv.Itoa(config.TunnelPort))
+		strconv.Itoa(config.TunnelPort), name, config.SharedKey, !config.NoMux)
 	waitSignal()
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+)
+
+// On SIGHUP, local reads the configuration file again. The credentials of
+// reverse socks, ACL, max_tunnels, heartbeat settings, timeout and debug
+// logging apply at once, the connection to server, TLS and listeners need
+// restart. An invalid configuration is not applied and local keeps running on
+// the old one.
+
+// settings are what reload replaces. They are published together, as the
+// goroutines of tunnels read them while reload runs.
+type settings struct {
+	config *depot.Config
+	acl    *depot.ACL // nil if no acl, which denies everything
+}
+
+var current atomic.Value // *settings
+
+func getSettings() *settings   { return current.Load().(*settings) }
+func getConfig() *depot.Config { return getSettings().config }
+func getACL() *depot.ACL       { return getSettings().acl }
+
+// localFixed are the fields which need restart to change.
+var localFixed = []string{"server_addr", "control_port", "tunnel_port",
+	"agent_name", "shared_key", "no_mux", "plaintext", "tls_cert", "tls_key",
+	"tls_ca", "tls_pins", "reverse_socks", "remote_forwards"}
+
+func reloadConfig() error {
+	c, changed, err := getConfig().Reload(localFixed...)
+	if err != nil {
+		return err
+	}
+	newACL, err := depot.NewACL(c.ACL)
+	if err != nil {
+		return fmt.Errorf("acl: %v", err)
+	}
+	if c.MaxTunnels < 0 || c.HeartbeatInterval < 0 || c.HeartbeatMisses < 0 {
+		return fmt.Errorf("max_tunnels and heartbeat settings must not be negative")
+	}
+
+	for _, name := range changed {
+		clog.Warn("reload:", name, "is changed, restart to apply it")
+	}
+	if newACL == nil {
+		clog.Warn(`no acl configured, all destinations are denied, set "acl": {"default": "allow"} to allow them`)
+	}
+
+	current.Store(&settings{config: c, acl: newACL})
+	depot.SetDebug(c.Debug)
+	c.ApplyTimeout()
+	atomic.StoreInt32(&maxTunnels, int32(c.MaxTunnels))
+	clog.Printf("reload configuration from %s\n", c.Path())
+	return nil
+}
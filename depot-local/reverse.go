@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+)
+
+// Reverse socks is the socks5 port on local, whose clients reach the network
+// of server. The connections are opened by server through the session, so it
+// needs the multiplexed control connection and server with reverse_acl.
+
+var (
+	errNoReverse = errors.New("server does not support reverse socks")
+
+	reverseMu      sync.Mutex
+	reverseSession *depot.Session // nil if not connected to server
+	reverseLn      net.Listener   // nil if reverse socks is disabled
+
+	numReverse int32 // reverse socks connections, accessed atomically
+)
+
+func setReverseSession(s *depot.Session) {
+	reverseMu.Lock()
+	reverseSession = s
+	reverseMu.Unlock()
+}
+
+func getReverseSession() *depot.Session {
+	reverseMu.Lock()
+	defer reverseMu.Unlock()
+	return reverseSession
+}
+
+// handleReverseConn opens a stream to server for the socks client, and pipes
+// them after server connects to the address.
+func handleReverseConn(conn net.Conn, user, password string) error {
+	atomic.AddInt32(&numReverse, 1)
+	defer atomic.AddInt32(&numReverse, -1)
+	defer conn.Close()
+	dbgLog.Printf("reverse socks connect from %s\n", conn.RemoteAddr().String())
+
+	method := depot.METHOD_NONE
+	if user != "" {
+		method = depot.METHOD_USERNAME
+	}
+	_, cmd, addrReq, err := depot.Socks5Request(conn, method,
+		func(u, p string) error {
+			if u != user || p != password {
+				return depot.ErrSocksAuth
+			}
+			return nil
+		})
+	if err != nil {
+		clog.Error("reverse", err)
+		return err
+	}
+	if cmd != depot.CmdConnect {
+		depot.SendSocksReply(conn, depot.RepCmdNotSupported, nil)
+		return depot.ErrSocksCmd
+	}
+
+	session := getReverseSession()
+	if session == nil {
+		clog.Warn("reverse socks to", addrReq.String()+":", errNoReverse)
+		depot.SendSocksReply(conn, depot.RepGeneralFailure, nil)
+		return errNoReverse
+	}
+	stream, err := session.Open()
+	if err != nil {
+		depot.SendSocksReply(conn, depot.RepGeneralFailure, nil)
+		return err
+	}
+	defer stream.Close()
+	dbgLog.Println("open reverse stream:", stream.ID(), "to", addrReq)
+
+	open := depot.Open{ID: stream.ID(), Cmd: cmd, Addr: addrReq.Raw}
+	if err = depot.WriteMsg(stream, depot.MsgOpen, &open); err != nil {
+		depot.SendSocksReply(conn, depot.RepGeneralFailure, nil)
+		return err
+	}
+	depot.SetReadTimeout(stream)
+	var result depot.OpenResult
+	if err = depot.ExpectMsg(stream, depot.MsgOpenResult, &result); err != nil {
+		depot.SendSocksReply(conn, depot.RepGeneralFailure, nil)
+		return err
+	}
+	if err = depot.SendSocksReply(conn, result.Rep, result.Bind); err != nil {
+		return err
+	}
+	if result.Rep != depot.RepSucceeded {
+		clog.Warn("reverse socks to", addrReq.String()+":", result.Error)
+		return errors.New(result.Error)
+	}
+
+	go depot.PipeThenClose(conn, stream)
+	depot.PipeThenClose(stream, conn)
+	dbgLog.Println("closed reverse connection to", addrReq)
+	return nil
+}
+
+// closeReverse stops listening for reverse socks clients.
+func closeReverse() {
+	reverseMu.Lock()
+	if reverseLn != nil {
+		reverseLn.Close()
+	}
+	reverseMu.Unlock()
+}
+
+// serveReverse listens on addr for the reverse socks clients, who
+// authenticate with user_name and password if user_name is not empty.
+func serveReverse(addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		clog.Fatal("reverse socks", err)
+	}
+	clog.Printf("listen on %s for reverse socks\n", addr)
+	reverseMu.Lock()
+	reverseLn = ln
+	reverseMu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if isShuttingDown() {
+				return
+			}
+			clog.Error("accept reverse socks:", err)
+			continue
+		}
+		c := getConfig()
+		go handleReverseConn(conn, c.UserName, c.Password)
+	}
+}
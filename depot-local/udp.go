@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+)
+
+// maxUDPDests is how many destinations an association caches.
+const maxUDPDests = 1024
+
+// udpDest is the checked destination of datagrams. It's cached for the
+// association, so a name is resolved and a denial is logged only once.
+type udpDest struct {
+	addr *net.UDPAddr
+	err  error // the datagrams are dropped if not nil
+}
+
+func checkUDPDest(addrReq *depot.AddrReq) udpDest {
+	addr, err := checkACL(addrReq)
+	if err != nil {
+		return udpDest{err: err}
+	}
+	dst, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		dbgLog.Println("drop datagrams to", addrReq.String()+":", err)
+	}
+	return udpDest{addr: dst, err: err}
+}
+
+// relayUDP sends the datagrams from the tunnel to their destinations and the
+// replies back through the tunnel, until the tunnel is closed or idle.
+func relayUDP(tunnelConn net.Conn, result *depot.OpenResult) error {
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return replyError(tunnelConn, result, depot.RepGeneralFailure, err)
+	}
+	defer udpConn.Close()
+	defer tunnelConn.Close()
+
+	if bind, err := depot.NewAddrReqFromAddr(udpConn.LocalAddr().String()); err == nil {
+		result.Bind = bind.Raw
+	}
+	if err = depot.WriteMsg(tunnelConn, depot.MsgOpenResult, result); err != nil {
+		return err
+	}
+	dbgLog.Println("udp relay at", udpConn.LocalAddr())
+
+	go relayReplies(udpConn, tunnelConn)
+
+	dests := make(map[string]udpDest)
+	buf := make([]byte, depot.MaxDatagram)
+	for {
+		depot.SetReadTimeout(tunnelConn)
+		n, err := depot.ReadDatagram(tunnelConn, buf)
+		if err != nil {
+			break
+		}
+		addrReq, data, err := depot.ParseUDPHeader(buf[:n])
+		if err != nil {
+			dbgLog.Println("drop datagram:", err)
+			continue
+		}
+		dst, ok := dests[addrReq.Address()]
+		if !ok {
+			if len(dests) >= maxUDPDests {
+				dests = make(map[string]udpDest)
+			}
+			dst = checkUDPDest(addrReq)
+			dests[addrReq.Address()] = dst
+		}
+		if dst.err != nil {
+			continue
+		}
+		udpConn.WriteToUDP(data, dst.addr)
+	}
+	dbgLog.Println("udp relay closed at", udpConn.LocalAddr())
+	return nil
+}
+
+// relayReplies sends datagrams received by the relay back to server, with
+// their source addresses. A datagram too long for the tunnel is dropped.
+func relayReplies(udpConn *net.UDPConn, tunnelConn net.Conn) {
+	buf := make([]byte, depot.MaxDatagram)
+	for {
+		n, src, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		addrReq, err := depot.NewAddrReqFromAddr(src.String())
+		if err != nil {
+			continue
+		}
+		b := append(depot.UDPHeader(addrReq), buf[:n]...)
+		if err := depot.WriteDatagram(tunnelConn, b); err == depot.ErrDatagramTooLong {
+			clog.Warn("drop udp reply from", src, "of", n, "bytes:", err)
+		} else if err != nil {
+			dbgLog.Println("udp relay:", err)
+			return
+		}
+	}
+}
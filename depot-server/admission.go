@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/choueric/clog"
+)
+
+// Admission control caps the concurrent sessions by max_sessions, after the
+// session is routed to an agent and before the tunnel is opened. A session
+// over the caps waits in the queue until another session is closed, or is
+// refused if the queue is full or it waits too long.
+
+const defaultQueueTimeout = 5 * time.Second
+
+var errTooManySessions = errors.New("too many sessions")
+
+// slotKey is the scope of a cap, e.g. {"user", "alice"}.
+type slotKey struct {
+	kind, name string
+}
+
+var (
+	admissionMu sync.Mutex
+	slots       = make(map[slotKey]int)
+	queued      int
+	// closed and replaced when a slot is released, to wake up the queue
+	slotReleased = make(chan struct{})
+)
+
+// sessionSlots returns the scopes of the session with their caps.
+func (s *session) sessionSlots() map[slotKey]int {
+	c := &getConfig().MaxSessions
+	keys := map[slotKey]int{
+		{"global", ""}:     c.Global,
+		{"agent", s.agent}: c.Agent,
+	}
+	if s.user != "" {
+		keys[slotKey{"user", s.user}] = c.User
+	}
+	if host, _, err := net.SplitHostPort(s.client); err == nil {
+		keys[slotKey{"ip", host}] = c.ClientIP
+	}
+	return keys
+}
+
+// tryAdmit takes the slots if none of them is full, with admissionMu held.
+func tryAdmit(keys map[slotKey]int) bool {
+	for k, max := range keys {
+		if max > 0 && slots[k] >= max {
+			return false
+		}
+	}
+	for k := range keys {
+		slots[k]++
+	}
+	return true
+}
+
+// admit takes the slots of the session, waiting in the queue if they are
+// full. The slots are released when the session is closed.
+func (s *session) admit() error {
+	s.mu.Lock()
+	keys := s.sessionSlots()
+	s.mu.Unlock()
+
+	admissionMu.Lock()
+	if tryAdmit(keys) {
+		admissionMu.Unlock()
+		s.setSlots(keys)
+		return nil
+	}
+	c := &getConfig().MaxSessions
+	if queued >= c.Queue {
+		admissionMu.Unlock()
+		clog.Warn("refuse session", s.id, "of", s.client, "to", s.target+":",
+			errTooManySessions)
+		return errTooManySessions
+	}
+	queued++
+	admissionMu.Unlock()
+	defer func() {
+		admissionMu.Lock()
+		queued--
+		admissionMu.Unlock()
+	}()
+
+	timeout := defaultQueueTimeout
+	if c.QueueTimeout > 0 {
+		timeout = time.Duration(c.QueueTimeout) * time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	dbgLog.Println("queue session", s.id, "of", s.client)
+	for {
+		admissionMu.Lock()
+		if tryAdmit(keys) {
+			admissionMu.Unlock()
+			s.setSlots(keys)
+			return nil
+		}
+		released := slotReleased
+		admissionMu.Unlock()
+
+		select {
+		case <-released:
+		case <-timer.C:
+			clog.Warn("refuse session", s.id, "of", s.client, "to",
+				s.target+": queue timeout,", errTooManySessions)
+			return errTooManySessions
+		}
+	}
+}
+
+func (s *session) setSlots(keys map[slotKey]int) {
+	s.mu.Lock()
+	s.slots = keys
+	s.mu.Unlock()
+}
+
+// releaseSlots releases the slots taken by admit.
+func releaseSlots(keys map[slotKey]int) {
+	if keys == nil {
+		return
+	}
+	admissionMu.Lock()
+	for k := range keys {
+		if slots[k]--; slots[k] <= 0 {
+			delete(slots, k)
+		}
+	}
+	close(slotReleased)
+	slotReleased = make(chan struct{})
+	admissionMu.Unlock()
+}
+
+// numQueued returns the number of sessions waiting in the queue.
+func numQueued() int {
+	admissionMu.Lock()
+	defer admissionMu.Unlock()
+	return queued
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+)
+
+// agent is a depot-local connected to the control port.
+type agent struct {
+	name     string
+	ctrlConn net.Conn
+	session  *depot.Session   // not nil if local supports multiplexing
+	beat     *depot.Heartbeat // not nil if local answers PING
+	start    time.Time
+
+	mu       sync.Mutex
+	closed   bool
+	forwards []net.Listener // remote forwards requested by local
+	rtt      time.Duration  // heartbeat round trip time reported by local
+	draining bool           // local is shutting down, no new sessions
+}
+
+var (
+	agentsMu sync.Mutex
+	agents   = make(map[string]*agent)
+)
+
+func newAgent(name string, ctrlConn net.Conn, mux, heartbeat bool) *agent {
+	a := &agent{
+		name:     name,
+		ctrlConn: ctrlConn,
+		start:    time.Now(),
+	}
+	if mux {
+		a.session = depot.NewSession(ctrlConn, true)
+	}
+	if heartbeat {
+		a.beat = new(depot.Heartbeat)
+	}
+	return a
+}
+
+// control returns the connection carrying control messages.
+func (a *agent) control() net.Conn {
+	if a.session != nil {
+		return a.session.Control()
+	}
+	return a.ctrlConn
+}
+
+func (a *agent) close() {
+	a.mu.Lock()
+	a.closed = true
+	a.mu.Unlock()
+	a.closeForwards()
+
+	if a.session != nil {
+		a.session.Close()
+	} else {
+		a.ctrlConn.Close()
+	}
+}
+
+// closeForwards stops listening on the ports of remote forwards.
+func (a *agent) closeForwards() {
+	a.mu.Lock()
+	for _, ln := range a.forwards {
+		ln.Close()
+	}
+	a.forwards = nil
+	a.mu.Unlock()
+}
+
+func (a *agent) setDraining() {
+	a.mu.Lock()
+	a.draining = true
+	a.mu.Unlock()
+}
+
+func (a *agent) isDraining() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.draining
+}
+
+func (a *agent) setRTT(rtt time.Duration) {
+	a.mu.Lock()
+	a.rtt = rtt
+	a.mu.Unlock()
+}
+
+// getRTT returns the heartbeat round trip time measured by server, or the
+// one reported by local if server doesn't send PING to it.
+func (a *agent) getRTT() time.Duration {
+	if rtt := a.beat.RTT(); rtt > 0 {
+		return rtt
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rtt
+}
+
+func heartbeatInterval() time.Duration {
+	return getConfig().HeartbeatDuration()
+}
+
+func heartbeatMisses() int {
+	return getConfig().MaxHeartbeatMisses()
+}
+
+// sayAlive sends heartbeats to local until done is closed, and closes the
+// agent if local misses them.
+func (a *agent) sayAlive(done <-chan struct{}) {
+	err := a.beat.Run(a.control(), heartbeatInterval, heartbeatMisses, done)
+	if err == depot.ErrPeerDead {
+		clog.Warn("agent", a.name, "is dead:", err)
+		heartbeatTimeouts.inc(a.name)
+		a.close()
+	}
+}
+
+func (a *agent) uptime() time.Duration {
+	return time.Since(a.start)
+}
+
+func registerAgent(a *agent) error {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+	if _, ok := agents[a.name]; ok {
+		return errors.New("agent " + a.name + " is already connected")
+	}
+	agents[a.name] = a
+	return nil
+}
+
+func unregisterAgent(a *agent) {
+	agentsMu.Lock()
+	if agents[a.name] == a {
+		delete(agents, a.name)
+	}
+	agentsMu.Unlock()
+}
+
+func findAgent(name string) *agent {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+	return agents[name]
+}
+
+func numAgents() int {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+	return len(agents)
+}
+
+// listAgents returns all connected agents sorted by name.
+func listAgents() []*agent {
+	agentsMu.Lock()
+	list := make([]*agent, 0, len(agents))
+	for _, a := range agents {
+		list = append(list, a)
+	}
+	agentsMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// matchDomain checks if host is in the domain, which can be written as
+// "home.depot" or "*.home.depot". The host without the domain suffix is
+// returned, empty if host is the domain itself.
+func matchDomain(host, domain string) (string, bool) {
+	domain = strings.TrimPrefix(domain, "*.")
+	if host == domain {
+		return "", true
+	}
+	if strings.HasSuffix(host, "."+domain) {
+		return strings.TrimSuffix(host, "."+domain), true
+	}
+	return "", false
+}
+
+// routeAgent chooses the agent for a socks session, in this order:
+// the agent bound to the socks port, the agent whose domain matches the
+// target host, the agent of the socks user, the default agent, and the only
+// connected agent. The returned request is the one to send to the agent.
+func routeAgent(bound, user string, addrReq *depot.AddrReq) (*agent, *depot.AddrReq, error) {
+	name, req, err := routeAgentName(bound, user, addrReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	var a *agent
+	if name == "" {
+		list := listAgents()
+		if len(list) != 1 {
+			return nil, nil, errors.New("no agent for " + addrReq.String())
+		}
+		a = list[0]
+	} else if a = findAgent(name); a == nil {
+		return nil, nil, errors.New("agent " + name + " is not connected")
+	}
+	if a.isDraining() {
+		return nil, nil, errors.New("agent " + a.name + " is shutting down")
+	}
+	return a, req, nil
+}
+
+// routeAgentName returns the name of the agent for the request, and the
+// request without the domain of the agent. The domain itself is refused, as it
+// names no host in the agent's network.
+func routeAgentName(bound, user string, addrReq *depot.AddrReq) (string,
+	*depot.AddrReq, error) {
+	if bound != "" {
+		return bound, addrReq, nil
+	}
+
+	config := getConfig()
+	for _, ac := range config.Agents {
+		for _, domain := range ac.Domains {
+			host, ok := matchDomain(addrReq.Host, domain)
+			if !ok {
+				continue
+			}
+			if host == "" {
+				return "", nil, errors.New("no host in " + addrReq.Host +
+					" of agent " + ac.Name)
+			}
+			req, err := depot.NewAddrReqFromAddr(net.JoinHostPort(host, addrReq.Port))
+			if err != nil {
+				continue
+			}
+			return ac.Name, req, nil
+		}
+	}
+
+	for _, ac := range config.Agents {
+		for _, u := range ac.Users {
+			if u == user {
+				return ac.Name, addrReq, nil
+			}
+		}
+	}
+
+	return config.DefaultAgent, addrReq, nil
+}
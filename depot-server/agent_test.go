@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/choueric/depot"
+)
+
+func TestRouteAgentName(t *testing.T) {
+	current.Store(&settings{config: &depot.Config{
+		Agents: []depot.AgentConfig{
+			{Name: "home", Domains: []string{"*.home.depot"}},
+			{Name: "office", Domains: []string{"office.depot"}, Users: []string{"bob"}},
+		},
+		DefaultAgent: "cloud",
+	}})
+	tests := []struct {
+		bound, user, addr string
+		name, req         string
+		fail              bool
+	}{
+		{addr: "nas.home.depot:9091", name: "home", req: "nas:9091"},
+		{addr: "a.b.office.depot:80", name: "office", req: "a.b:80"},
+		{addr: "home.depot:22", fail: true},
+		{addr: "office.depot:22", fail: true},
+		{addr: "nashome.depot:80", name: "cloud", req: "nashome.depot:80"},
+		{user: "bob", addr: "example.com:443", name: "office", req: "example.com:443"},
+		{bound: "home", addr: "home.depot:22", name: "home", req: "home.depot:22"},
+	}
+	for _, tt := range tests {
+		addrReq, err := depot.NewAddrReqFromAddr(tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, req, err := routeAgentName(tt.bound, tt.user, addrReq)
+		if (err != nil) != tt.fail {
+			t.Errorf("route %s: error = %v", tt.addr, err)
+			continue
+		}
+		if !tt.fail && (name != tt.name || req.Address() != tt.req) {
+			t.Errorf("route %s = %s %s, want %s %s", tt.addr, name,
+				req.Address(), tt.name, tt.req)
+		}
+	}
+}
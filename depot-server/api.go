@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/choueric/depot"
+)
+
+// The JSON API on the web port has the same data as the web page:
+//
+// -  GET /api/v1/status: version, ports, uptime and numbers of agents and
+//    sessions.
+// -  GET /api/v1/agents: connected agents.
+// -  GET /api/v1/sessions: active sessions, or closed ones with
+//    "?state=closed".
+// -  GET /api/v1/sessions/{id}: an active or closed session.
+// -  GET /api/v1/limits: rate limits in the format of rate_limit.
+// -  PUT /api/v1/limits/global, /api/v1/limits/session,
+//    /api/v1/limits/users/{name}, /api/v1/limits/agents/{name} and
+//    /api/v1/sessions/{id}/limit with {"rate": bytes per second}: change the
+//    rate limit, 0 for no limit. The session limit applies to new sessions.
+//    They need web_admin, see webauth.go.
+//
+// Errors are returned as {"error": "..."} with the HTTP status.
+
+const apiPrefix = "/api/v1/"
+
+var serverStart = time.Now()
+
+type apiStatus struct {
+	Version        string    `json:"version"`
+	SocksPort      int       `json:"socks_port"`
+	CtrlPort       int       `json:"control_port"`
+	HTTPPort       int       `json:"http_port,omitempty"`
+	Start          time.Time `json:"start"`
+	Uptime         float64   `json:"uptime"` // seconds
+	Agents         int       `json:"agents"`
+	Sessions       int       `json:"sessions"`
+	ClosedSessions int       `json:"closed_sessions"`
+}
+
+type apiAgent struct {
+	Name    string    `json:"name"`
+	Addr    string    `json:"addr"`
+	Start   time.Time `json:"start"`
+	Uptime  float64   `json:"uptime"` // seconds
+	Mux     bool      `json:"mux"`
+	Streams int       `json:"streams"`       // open streams if mux
+	RTT     float64   `json:"rtt,omitempty"` // heartbeat seconds
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func apiGetStatus() apiStatus {
+	sessionsMu.Lock()
+	nsessions, nclosed := len(sessions), len(closedSessions)
+	sessionsMu.Unlock()
+	config := getConfig()
+	return apiStatus{
+		Version:        depot.VERSION,
+		SocksPort:      config.ServerPort,
+		CtrlPort:       config.ControlPort,
+		HTTPPort:       config.HTTPPort,
+		Start:          serverStart,
+		Uptime:         time.Since(serverStart).Seconds(),
+		Agents:         numAgents(),
+		Sessions:       nsessions,
+		ClosedSessions: nclosed,
+	}
+}
+
+func apiGetAgents() []apiAgent {
+	list := make([]apiAgent, 0)
+	for _, a := range listAgents() {
+		info := apiAgent{
+			Name:   a.name,
+			Addr:   a.ctrlConn.RemoteAddr().String(),
+			Start:  a.start,
+			Uptime: a.uptime().Seconds(),
+			Mux:    a.session != nil,
+			RTT:    a.getRTT().Seconds(),
+		}
+		if a.session != nil {
+			info.Streams = a.session.NumStreams()
+		}
+		list = append(list, info)
+	}
+	return list
+}
+
+// apiSetLimit changes the rate limit of the scope to the rate in the body.
+func apiSetLimit(w http.ResponseWriter, r *http.Request, scope, name string) {
+	var body struct {
+		Rate *int64 `json:"rate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Rate == nil {
+		writeAPIError(w, http.StatusBadRequest, "need {\"rate\": bytes per second}")
+		return
+	}
+	if err := setLimit(scope, name, *body.Rate); err != nil {
+		status := http.StatusBadRequest
+		if err == errSessionNotFound {
+			status = http.StatusNotFound
+		}
+		writeAPIError(w, status, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, currentLimits())
+}
+
+// apiHandler dispatches the API requests by the path after apiPrefix.
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+	parts := strings.Split(path, "/")
+
+	if r.Method == http.MethodPut {
+		if status, err := authWebAdmin(w, r); err != nil {
+			writeAPIError(w, status, err.Error())
+			return
+		}
+		switch {
+		case path == "limits/global", path == "limits/session":
+			apiSetLimit(w, r, parts[1], "")
+		case len(parts) == 3 && parts[0] == "limits" &&
+			(parts[1] == "users" || parts[1] == "agents"):
+			apiSetLimit(w, r, strings.TrimSuffix(parts[1], "s"), parts[2])
+		case len(parts) == 3 && parts[0] == "sessions" && parts[2] == "limit":
+			apiSetLimit(w, r, "id", parts[1])
+		default:
+			writeAPIError(w, http.StatusNotFound, "not found")
+		}
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	switch {
+	case path == "status":
+		writeJSON(w, http.StatusOK, apiGetStatus())
+	case path == "agents":
+		writeJSON(w, http.StatusOK, apiGetAgents())
+	case path == "limits":
+		writeJSON(w, http.StatusOK, currentLimits())
+	case path == "sessions":
+		switch r.URL.Query().Get("state") {
+		case "", "active":
+			writeJSON(w, http.StatusOK, listSessions())
+		case "closed":
+			writeJSON(w, http.StatusOK, listClosedSessions())
+		default:
+			writeAPIError(w, http.StatusBadRequest, "invalid state")
+		}
+	case len(parts) == 2 && parts[0] == "sessions":
+		id, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid session id")
+			return
+		}
+		st, ok := findSession(id)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, errSessionNotFound.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, st)
+	default:
+		writeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+)
+
+// handleBind asks local to listen for the peer of BIND. The client gets two
+// replies, one with local's listening address and one with the address of
+// the peer which connected, then the peer is piped with the client.
+func handleBind(socksConn net.Conn, a *agent, addrReq *depot.AddrReq,
+	reply socksReplier, s *session) error {
+	tunnelConn, result, err := getTunnel(a, depot.CmdBind, addrReq)
+	if err != nil {
+		clog.Error("Failed bind on local:", err)
+		reply(socksConn, failureRep(result), nil)
+		return err
+	}
+	// the result of the peer is read from the raw connection, only the piped
+	// data counts for the session
+	rawConn := tunnelConn
+	tunnelConn = s.count(tunnelConn)
+	if err = reply(socksConn, depot.RepSucceeded, result.Bind); err != nil {
+		tunnelConn.Close()
+		return err
+	}
+
+	// wait for the peer, local gives up if no one connects in time
+	rawConn.SetReadDeadline(time.Time{})
+	peer := new(depot.OpenResult)
+	if err = depot.ExpectMsg(rawConn, depot.MsgOpenResult, peer); err != nil {
+		peer = nil
+	} else if peer.Rep != depot.RepSucceeded {
+		err = errors.New("local: " + peer.Error)
+	}
+	if err != nil {
+		clog.Error("bind", addrReq, "error:", err)
+		reply(socksConn, failureRep(peer), nil)
+		tunnelConn.Close()
+		return err
+	}
+	if err = reply(socksConn, depot.RepSucceeded, peer.Bind); err != nil {
+		tunnelConn.Close()
+		return err
+	}
+
+	go depot.PipeThenClose(socksConn, tunnelConn)
+	depot.PipeThenClose(tunnelConn, socksConn)
+	dbgLog.Println("closed bind connection for", addrReq)
+	return nil
+}
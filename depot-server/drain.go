@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+)
+
+// On SIGTERM or SIGINT, server closes its socks, HTTP proxy, forward, control
+// and tunnel ports, tells the agents by SHUTDOWN, and waits for the active
+// sessions up to drain_timeout. Then the sessions left and the control
+// connections are closed.
+
+var (
+	shuttingDown int32 // accessed atomically
+
+	listenersMu sync.Mutex
+	listeners   []net.Listener // closed at shutdown
+)
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) != 0
+}
+
+// trackListener registers ln to be closed at shutdown.
+func trackListener(ln net.Listener) net.Listener {
+	listenersMu.Lock()
+	listeners = append(listeners, ln)
+	listenersMu.Unlock()
+	return ln
+}
+
+func shutdown() {
+	atomic.StoreInt32(&shuttingDown, 1)
+	start := time.Now()
+	drain := getConfig().DrainDuration()
+
+	listenersMu.Lock()
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	listenersMu.Unlock()
+
+	for _, a := range listAgents() {
+		a.closeForwards()
+		sd := depot.Shutdown{Drain: int(drain / time.Second)}
+		if err := depot.WriteMsg(a.control(), depot.MsgShutdown, &sd); err != nil {
+			clog.Error("shutdown agent", a.name+":", err)
+		}
+	}
+
+	n := numSessions()
+	clog.Printf("shutdown: drain %d sessions in %v\n", n, drain)
+	deadline := time.Now().Add(drain)
+	for numSessions() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	aborted := abortSessions("server shutdown")
+
+	agents := listAgents()
+	for _, a := range agents {
+		depot.WriteMsg(a.control(), depot.MsgClose,
+			&depot.Close{Reason: "server shutdown"})
+		a.close()
+	}
+	clog.Printf("shutdown: %d sessions at shutdown, %d closed at drain timeout, "+
+		"%d agents closed, in %v\n", n, aborted, len(agents),
+		time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+)
+
+// handleForwardConn tunnels the connection to the target of the forward.
+func handleForwardConn(conn net.Conn, bound string,
+	target *depot.AddrReq) (err error) {
+	dbgLog.Printf("forward connect from %s\n", conn.RemoteAddr().String())
+	defer conn.Close()
+
+	s := newSession("forward", conn.RemoteAddr(), "", target)
+	defer func() { s.close(err) }()
+
+	a, addrReq, _, _, err := routeRequest(bound, "", socksCmdConnect, target)
+	if err != nil {
+		return err
+	}
+	s.setAgent(a)
+	if err = s.admit(); err != nil {
+		return err
+	}
+
+	tunnelConn, _, err := getTunnel(a, depot.CmdConnect, addrReq)
+	if err != nil {
+		clog.Error("Failed connect to local:", err)
+		return err
+	}
+	tunnelConn = s.count(tunnelConn)
+	defer tunnelConn.Close()
+
+	go depot.PipeThenClose(conn, tunnelConn)
+	depot.PipeThenClose(tunnelConn, conn)
+	dbgLog.Println("closed forward connection to", addrReq)
+	return nil
+}
+
+// serveForward tunnels all connections on the port to target. If agent is
+// not empty, they go to that agent.
+func serveForward(host, port, agent string, target *depot.AddrReq) {
+	ln, err := listen(host, port, "forward to "+target.String())
+	if err != nil {
+		clog.Fatal("forward", err)
+	}
+	trackListener(ln)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if isShuttingDown() {
+				return
+			}
+			clog.Error("accept forward:", err)
+			continue
+		}
+		if numAgents() == 0 {
+			conn.Close()
+			clog.Warn("no control connection yet")
+			continue
+		}
+		go handleForwardConn(conn, agent, target)
+	}
+}
+
+// addForward listens on the port requested by local, until the agent is
+// closed. The port must be in remote_ports.
+func (a *agent) addForward(f *depot.Forward) error {
+	if !getRemotePorts().Contains(f.Port) {
+		return fmt.Errorf("port %d is not allowed", f.Port)
+	}
+	target, err := depot.NewReqAddr(f.Addr)
+	if err != nil {
+		return err
+	}
+
+	ln, err := listen(listenAddr, strconv.Itoa(f.Port),
+		"remote forward of "+a.name+" to "+target.String())
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		ln.Close()
+		return errors.New("agent is closed")
+	}
+	a.forwards = append(a.forwards, ln)
+	a.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil { // closed with the agent
+				dbgLog.Println("stop remote forward", f.Port, "of", a.name)
+				return
+			}
+			go handleForwardConn(conn, a.name, target)
+		}
+	}()
+	return nil
+}
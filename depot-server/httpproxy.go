@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+)
+
+// The HTTP proxy port accepts CONNECT for any TCP connection, and plain HTTP
+// requests with absolute URI, which are forwarded one request per tunnel.
+// Clients authenticate with Proxy-Authorization Basic as the socks users.
+
+// hop-by-hop headers, which are not forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// httpStatus maps the reply code of tunnel to HTTP status.
+func httpStatus(rep byte) int {
+	switch rep {
+	case depot.RepNotAllowed:
+		return http.StatusForbidden
+	case depot.RepTTLExpired:
+		return http.StatusGatewayTimeout
+	case depot.RepCmdNotSupported, depot.RepAddrTypeUnsupported:
+		return http.StatusBadRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func sendHTTPError(conn net.Conn, status int, header string) {
+	text := http.StatusText(status)
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Type: text/plain\r\n"+
+		"Content-Length: %d\r\nConnection: close\r\n\r\n%s\n",
+		status, text, header, len(text)+1, text)
+}
+
+// httpAuthenticate returns the user of the request, or error if the
+// credentials are missing or wrong.
+func httpAuthenticate(req *http.Request) (string, error) {
+	if getTargetMethod() == depot.METHOD_NONE {
+		return "", nil
+	}
+	auth := req.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if !strings.HasPrefix(auth, prefix) {
+		return "", errors.New("http proxy: no credentials")
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", err
+	}
+	cred := string(b)
+	i := strings.Index(cred, ":")
+	if i < 0 {
+		return "", errors.New("http proxy: invalid credentials")
+	}
+	return cred[:i], checkUser(cred[:i], cred[i+1:])
+}
+
+// httpTarget returns the address of the request.
+func httpTarget(req *http.Request) (*depot.AddrReq, error) {
+	if req.Method == http.MethodConnect {
+		return depot.NewAddrReqFromAddr(req.Host)
+	}
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		return nil, errors.New("http proxy: not an absolute http URI " +
+			req.URL.String())
+	}
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		host = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	return depot.NewAddrReqFromAddr(host)
+}
+
+// forwardHTTP sends the request to the app through the tunnel and sends back
+// the response, then both are closed.
+func forwardHTTP(conn, tunnelConn net.Conn, req *http.Request) error {
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Close = true
+	if err := req.Write(tunnelConn); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(tunnelConn), req)
+	if err != nil {
+		sendHTTPError(conn, http.StatusBadGateway, "")
+		return err
+	}
+	defer resp.Body.Close()
+	resp.Close = true
+	return resp.Write(conn)
+}
+
+func handleHTTPConn(conn net.Conn) (err error) {
+	dbgLog.Printf("http proxy connect from %s\n", conn.RemoteAddr().String())
+	defer conn.Close()
+
+	depot.SetReadTimeout(conn)
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		clog.Error("http proxy request:", err)
+		return
+	}
+
+	user, err := httpAuthenticate(req)
+	if err != nil {
+		clog.Error("http proxy authenticate", user+":", err)
+		handshakeFailures.inc(authFailureReason(err, "http_credentials"))
+		sendHTTPError(conn, http.StatusProxyAuthRequired,
+			"Proxy-Authenticate: Basic realm=\"depot\"\r\n")
+		return
+	}
+
+	addrReq, err := httpTarget(req)
+	if err != nil {
+		clog.Error(err)
+		sendHTTPError(conn, http.StatusBadRequest, "")
+		return
+	}
+	dbgLog.Println("request address:", addrReq)
+
+	kind := "http"
+	if req.Method == http.MethodConnect {
+		kind = "http connect"
+	}
+	s := newSession(kind, conn.RemoteAddr(), user, addrReq)
+	defer func() { s.close(err) }()
+
+	a, addrReq, _, rep, err := routeRequest("", user, socksCmdConnect, addrReq)
+	if err != nil {
+		sendHTTPError(conn, httpStatus(rep), "")
+		return
+	}
+	s.setAgent(a)
+	if err = s.admit(); err != nil {
+		sendHTTPError(conn, http.StatusServiceUnavailable, "")
+		return
+	}
+
+	tunnelConn, result, err := getTunnel(a, depot.CmdConnect, addrReq)
+	if err != nil {
+		clog.Error("Failed connect to local:", err)
+		sendHTTPError(conn, httpStatus(failureRep(result)), "")
+		return
+	}
+	tunnelConn = s.count(tunnelConn)
+	defer tunnelConn.Close()
+
+	if req.Method != http.MethodConnect {
+		return forwardHTTP(conn, tunnelConn, req)
+	}
+
+	if _, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	// the client may send data before getting the reply
+	if n := br.Buffered(); n > 0 {
+		b, _ := br.Peek(n)
+		if _, err = tunnelConn.Write(b); err != nil {
+			return
+		}
+	}
+
+	go depot.PipeThenClose(conn, tunnelConn)
+	depot.PipeThenClose(tunnelConn, conn)
+	dbgLog.Println("closed connection for addReq", addrReq)
+	return nil
+}
+
+func serveHTTP(host, port string) {
+	ln, err := listen(host, port, "http proxy")
+	if err != nil {
+		clog.Fatal("http proxy", err)
+	}
+	trackListener(ln)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if isShuttingDown() {
+				return
+			}
+			clog.Error("accept http proxy:", err)
+			continue
+		}
+		if numAgents() == 0 {
+			conn.Close()
+			clog.Warn("no control connection yet")
+			continue
+		}
+		go handleHTTPConn(conn)
+	}
+}
@@ -0,0 +1,10 @@
+// reload the page every few seconds, unless a form is being edited
+function autoRefresh(seconds) {
+	setInterval(function() {
+		var e = document.activeElement;
+		if (e && (e.tagName == "INPUT" || e.tagName == "SELECT")) {
+			return;
+		}
+		location.reload();
+	}, seconds * 1000);
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/choueric/depot"
+)
+
+// Bandwidth limits of sessions, configured by rate_limit and adjustable on
+// the web port. Every session waits for the global limiter, the limiters of
+// its user and agent, and its own one, each has a bucket for both directions.
+
+// limiterPair limits both directions by the same rate.
+type limiterPair struct {
+	up   *depot.RateLimiter
+	down *depot.RateLimiter
+}
+
+func newLimiterPair(rate int64) *limiterPair {
+	return &limiterPair{depot.NewRateLimiter(rate), depot.NewRateLimiter(rate)}
+}
+
+func (p *limiterPair) setRate(rate int64) {
+	p.up.SetRate(rate)
+	p.down.SetRate(rate)
+}
+
+func (p *limiterPair) rate() int64 {
+	return p.up.Rate()
+}
+
+var (
+	limitsMu    sync.Mutex
+	globalLimit = newLimiterPair(0)
+	sessionRate int64 // rate of new sessions
+	userLimits  = make(map[string]*limiterPair)
+	agentLimits = make(map[string]*limiterPair)
+)
+
+var errNegativeRate = errors.New("rate must not be negative")
+
+func checkLimits(c *depot.RateLimitConfig) error {
+	if c.Global < 0 || c.Session < 0 {
+		return errNegativeRate
+	}
+	for name, rate := range c.Users {
+		if rate < 0 {
+			return fmt.Errorf("user %s: %v", name, errNegativeRate)
+		}
+	}
+	for name, rate := range c.Agents {
+		if rate < 0 {
+			return fmt.Errorf("agent %s: %v", name, errNegativeRate)
+		}
+	}
+	return nil
+}
+
+// initLimits applies the limits of c, users and agents not in c are no longer
+// limited. The active sessions are limited by the new rates at once.
+func initLimits(c *depot.RateLimitConfig) error {
+	if err := checkLimits(c); err != nil {
+		return err
+	}
+	globalLimit.setRate(c.Global)
+	limitsMu.Lock()
+	sessionRate = c.Session
+	for name, p := range userLimits {
+		p.setRate(c.Users[name])
+	}
+	for name, p := range agentLimits {
+		p.setRate(c.Agents[name])
+	}
+	limitsMu.Unlock()
+	for name, rate := range c.Users {
+		userLimit(name).setRate(rate)
+	}
+	for name, rate := range c.Agents {
+		agentLimit(name).setRate(rate)
+	}
+	return nil
+}
+
+// getLimiter returns the limiter of name in m, a new one without limit if
+// there is none, so its rate can be changed later for the sessions using it.
+func getLimiter(m map[string]*limiterPair, name string) *limiterPair {
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	p := m[name]
+	if p == nil {
+		p = newLimiterPair(0)
+		m[name] = p
+	}
+	return p
+}
+
+func userLimit(name string) *limiterPair {
+	return getLimiter(userLimits, name)
+}
+
+func agentLimit(name string) *limiterPair {
+	return getLimiter(agentLimits, name)
+}
+
+func newSessionLimit() *limiterPair {
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	return newLimiterPair(sessionRate)
+}
+
+// currentLimits returns the limits in the format of rate_limit.
+func currentLimits() depot.RateLimitConfig {
+	c := depot.RateLimitConfig{
+		Global: globalLimit.rate(),
+		Users:  make(map[string]int64),
+		Agents: make(map[string]int64),
+	}
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	c.Session = sessionRate
+	for name, p := range userLimits {
+		if rate := p.rate(); rate != 0 {
+			c.Users[name] = rate
+		}
+	}
+	for name, p := range agentLimits {
+		if rate := p.rate(); rate != 0 {
+			c.Agents[name] = rate
+		}
+	}
+	return c
+}
+
+// setLimit changes the rate of the scope: "global", "session" for new
+// sessions, "user" or "agent" of name, or "id" for the active session of ID
+// name.
+func setLimit(scope, name string, rate int64) error {
+	if rate < 0 {
+		return errNegativeRate
+	}
+	switch scope {
+	case "global":
+		globalLimit.setRate(rate)
+	case "session":
+		limitsMu.Lock()
+		sessionRate = rate
+		limitsMu.Unlock()
+	case "user", "agent":
+		if name == "" {
+			return errors.New("no " + scope + " name")
+		}
+		if scope == "user" {
+			userLimit(name).setRate(rate)
+		} else {
+			agentLimit(name).setRate(rate)
+		}
+	case "id":
+		id, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			return errors.New("invalid session id")
+		}
+		s := activeSession(id)
+		if s == nil {
+			return errSessionNotFound
+		}
+		s.limit.setRate(rate)
+	default:
+		return errors.New("invalid scope " + scope)
+	}
+	dbgLog.Println("set rate limit of", scope, name, "to", rate)
+	return nil
+}
+
+// parseRate parses the rate in bytes per second, with optional suffix K, M
+// or G in units of 1024.
+func parseRate(str string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(str))
+	mul := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mul = 1 << 10
+		case 'M':
+			mul = 1 << 20
+		case 'G':
+			mul = 1 << 30
+		}
+		if mul != 1 {
+			s = s[:n-1]
+		}
+	}
+	rate, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid rate %q", str)
+	}
+	return rate * mul, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/choueric/depot"
+)
+
+// Metrics of server in the Prometheus text format, on /metrics of the web
+// port. They are written by hand to keep server free of dependencies.
+
+// counterVec is a counter with one label.
+type counterVec struct {
+	mu sync.Mutex
+	m  map[string]uint64
+}
+
+func (c *counterVec) inc(label string) {
+	c.mu.Lock()
+	if c.m == nil {
+		c.m = make(map[string]uint64)
+	}
+	c.m[label]++
+	c.mu.Unlock()
+}
+
+// values returns the labels sorted and their values.
+func (c *counterVec) values() ([]string, []uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	labels := make([]string, 0, len(c.m))
+	for l := range c.m {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	values := make([]uint64, len(labels))
+	for i, l := range labels {
+		values[i] = c.m[l]
+	}
+	return labels, values
+}
+
+// histogram counts the observations in buckets of upper bounds.
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64 // not cumulative
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// traffic is the bytes of sessions through an agent.
+type traffic struct {
+	up   uint64 // accessed atomically
+	down uint64 // accessed atomically
+}
+
+var (
+	sessionResults    counterVec // closed sessions by result
+	handshakeFailures counterVec // failed handshakes of clients and agents by reason
+	agentConnects     counterVec // control connections by agent
+	heartbeatTimeouts counterVec // agents closed for missed heartbeats
+
+	trafficMu     sync.Mutex
+	agentTraffics = make(map[string]*traffic)
+
+	// seconds from OPEN to OPEN_RESULT
+	tunnelSetup = newHistogram(.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10)
+)
+
+// agentTraffic returns the traffic counter of the agent.
+func agentTraffic(name string) *traffic {
+	trafficMu.Lock()
+	defer trafficMu.Unlock()
+	t := agentTraffics[name]
+	if t == nil {
+		t = new(traffic)
+		agentTraffics[name] = t
+	}
+	return t
+}
+
+// sessionResult returns the result label of the session closed with err.
+func sessionResult(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, depot.ErrNotAllowed), err == errPolicyTime,
+		err == errPolicyAgent:
+		return "refused"
+	case err == errTooManySessions:
+		return "rejected"
+	default:
+		return "failed"
+	}
+}
+
+// authFailureReason returns the reason label of the failed handshake of
+// socks or HTTP proxy client, other is for errors not of authentication.
+func authFailureReason(err error, other string) string {
+	switch {
+	case errors.Is(err, depot.ErrSocksAuth):
+		return "bad_password"
+	case errors.Is(err, errUserDisabled):
+		return "user_disabled"
+	case errors.Is(err, errUserExpired):
+		return "user_expired"
+	default:
+		return other
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeCounterVec(w io.Writer, name, label, help string, c *counterVec) {
+	writeHeader(w, name, "counter", help)
+	labels, values := c.values()
+	for i, l := range labels {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, labelEscaper.Replace(l),
+			values[i])
+	}
+}
+
+func writeHistogram(w io.Writer, name, help string, h *histogram) {
+	writeHeader(w, name, "histogram", help)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var n uint64
+	for i, b := range h.bounds {
+		n += h.buckets[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, b, n)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func writeMetrics(w io.Writer) {
+	writeHeader(w, "depot_sessions_active", "gauge", "Active sessions.")
+	fmt.Fprintf(w, "depot_sessions_active %d\n", numSessions())
+	writeHeader(w, "depot_sessions_queued", "gauge",
+		"Sessions waiting for admission.")
+	fmt.Fprintf(w, "depot_sessions_queued %d\n", numQueued())
+
+	writeCounterVec(w, "depot_sessions_total", "result",
+		"Closed sessions by result.", &sessionResults)
+
+	writeHeader(w, "depot_bytes_total", "counter",
+		"Bytes of sessions through agents, up is to the target.")
+	trafficMu.Lock()
+	names := make([]string, 0, len(agentTraffics))
+	for name := range agentTraffics {
+		names = append(names, name)
+	}
+	trafficMu.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		t := agentTraffic(name)
+		name = labelEscaper.Replace(name)
+		fmt.Fprintf(w, "depot_bytes_total{agent=\"%s\",direction=\"up\"} %d\n",
+			name, atomic.LoadUint64(&t.up))
+		fmt.Fprintf(w, "depot_bytes_total{agent=\"%s\",direction=\"down\"} %d\n",
+			name, atomic.LoadUint64(&t.down))
+	}
+
+	writeCounterVec(w, "depot_handshake_failures_total", "reason",
+		"Failed handshakes of clients and agents by reason.", &handshakeFailures)
+
+	writeCounterVec(w, "depot_agent_connects_total", "agent",
+		"Control connections of agents.", &agentConnects)
+	writeHeader(w, "depot_agent_up", "gauge",
+		"1 if the control connection of the agent is up.")
+	agentNames, _ := agentConnects.values()
+	for _, name := range agentNames {
+		up := 0
+		if findAgent(name) != nil {
+			up = 1
+		}
+		fmt.Fprintf(w, "depot_agent_up{agent=\"%s\"} %d\n",
+			labelEscaper.Replace(name), up)
+	}
+
+	writeHeader(w, "depot_agent_heartbeat_rtt_seconds", "gauge",
+		"Heartbeat round trip time of the agent.")
+	for _, a := range listAgents() {
+		if rtt := a.getRTT(); rtt > 0 {
+			fmt.Fprintf(w, "depot_agent_heartbeat_rtt_seconds{agent=\"%s\"} %g\n",
+				labelEscaper.Replace(a.name), rtt.Seconds())
+		}
+	}
+
+	writeCounterVec(w, "depot_agent_heartbeat_timeouts_total", "agent",
+		"Agents closed for missed heartbeats.", &heartbeatTimeouts)
+
+	writeHistogram(w, "depot_tunnel_setup_seconds",
+		"Time from OPEN to OPEN_RESULT of tunnels.", tunnelSetup)
+
+	buf := depot.PipeBufStats()
+	writeHeader(w, "depot_leakybuf_free", "gauge", "Free buffers in the pool.")
+	fmt.Fprintf(w, "depot_leakybuf_free %d\n", buf.Free)
+	writeHeader(w, "depot_leakybuf_capacity", "gauge",
+		"Max free buffers in the pool.")
+	fmt.Fprintf(w, "depot_leakybuf_capacity %d\n", buf.Cap)
+	writeHeader(w, "depot_leakybuf_gets_total", "counter",
+		"Buffers got from the pool.")
+	fmt.Fprintf(w, "depot_leakybuf_gets_total %d\n", buf.Gets)
+	writeHeader(w, "depot_leakybuf_misses_total", "counter",
+		"Buffers allocated because the pool was empty.")
+	fmt.Fprintf(w, "depot_leakybuf_misses_total %d\n", buf.Misses)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+)
+
+// A policy limits what the socks users with it can do, it's defined in the
+// users file and referred by the users, e.g.
+//
+//  "policies": {
+//      "guest": {
+//          "acl": {"rules": [{"action": "allow", "host": "nas", "ports": "9091"}]},
+//          "agents": ["home"],
+//          "times": ["Mon-Fri 09:00-18:00", "Sat,Sun 10:00-12:00"]
+//      }
+//  }
+//
+// -  acl: destinations the users can reach, the same as local's acl, all if
+//    absent. Server checks the address as requested, without resolving names,
+//    so a name is denied by the deny rules of ip and CIDR, see
+//    ACL.AllowUnresolved.
+// -  agents: agents the users can use, all if empty.
+// -  times: when the users can open sessions, in server's time zone. A window
+//    ending before it starts ends on the next day.
+
+var (
+	errPolicyTime  = errors.New("not allowed at this time")
+	errPolicyAgent = errors.New("agent not allowed")
+)
+
+type policyConfig struct {
+	ACL    *depot.ACLConfig `json:"acl"`
+	Agents []string         `json:"agents"`
+	Times  []string         `json:"times"`
+}
+
+type timeWindow struct {
+	days     [7]bool
+	from, to int // minutes in the day
+}
+
+type policy struct {
+	acl    *depot.ACL
+	agents map[string]bool
+	times  []timeWindow
+}
+
+var weekdays = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+func parseWeekday(s string) (int, error) {
+	d, ok := weekdays[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("invalid weekday %q", s)
+	}
+	return d, nil
+}
+
+// parseDays parses "Mon-Fri,Sun" into the days of week.
+func parseDays(s string, days *[7]bool) error {
+	for _, f := range strings.Split(s, ",") {
+		lo, hi := f, f
+		if i := strings.Index(f, "-"); i >= 0 {
+			lo, hi = f[:i], f[i+1:]
+		}
+		from, err := parseWeekday(lo)
+		if err != nil {
+			return err
+		}
+		to, err := parseWeekday(hi)
+		if err != nil {
+			return err
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock parses "09:30" into minutes, "24:00" is allowed.
+func parseClock(s string) (int, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	h, err1 := strconv.Atoi(s[:i])
+	m, err2 := strconv.Atoi(s[i+1:])
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 ||
+		h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// parseTimeWindow parses "[days] [hh:mm-hh:mm]", e.g. "Mon-Fri 09:00-18:00",
+// "Sat,Sun" or "22:00-06:00".
+func parseTimeWindow(s string) (w timeWindow, err error) {
+	w.to = 24 * 60
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("invalid time window %q", s)
+	}
+
+	hours := ""
+	switch {
+	case len(fields) == 2:
+		err = parseDays(fields[0], &w.days)
+		hours = fields[1]
+	case strings.Contains(fields[0], ":"):
+		w.days = [7]bool{true, true, true, true, true, true, true}
+		hours = fields[0]
+	default:
+		err = parseDays(fields[0], &w.days)
+	}
+	if err != nil || hours == "" {
+		return w, err
+	}
+
+	i := strings.Index(hours, "-")
+	if i < 0 {
+		return w, fmt.Errorf("invalid time window %q", s)
+	}
+	if w.from, err = parseClock(hours[:i]); err != nil {
+		return w, err
+	}
+	w.to, err = parseClock(hours[i+1:])
+	return w, err
+}
+
+func (w *timeWindow) contains(t time.Time) bool {
+	day := int(t.Weekday())
+	m := t.Hour()*60 + t.Minute()
+	if w.from < w.to {
+		return w.days[day] && m >= w.from && m < w.to
+	}
+	// crossing midnight
+	return (w.days[day] && m >= w.from) || (w.days[(day+6)%7] && m < w.to)
+}
+
+func newPolicy(c *policyConfig) (*policy, error) {
+	p := new(policy)
+	if c == nil {
+		return p, nil
+	}
+	var err error
+	if p.acl, err = depot.NewACL(c.ACL); err != nil {
+		return nil, err
+	}
+	if len(c.Agents) != 0 {
+		p.agents = make(map[string]bool)
+		for _, name := range c.Agents {
+			p.agents[name] = true
+		}
+	}
+	for _, s := range c.Times {
+		w, err := parseTimeWindow(s)
+		if err != nil {
+			return nil, err
+		}
+		p.times = append(p.times, w)
+	}
+	return p, nil
+}
+
+// allowDest checks the destination with the acl. A nil policy or a policy
+// without acl allows everything.
+func (p *policy) allowDest(addrReq *depot.AddrReq) error {
+	if p == nil || p.acl == nil {
+		return nil
+	}
+	port, _ := strconv.Atoi(addrReq.Port)
+	allow := false
+	if ip := net.ParseIP(addrReq.Host); ip != nil {
+		allow = p.acl.Allow("", ip, port)
+	} else {
+		allow = p.acl.AllowUnresolved(addrReq.Host, port)
+	}
+	if !allow {
+		return depot.ErrNotAllowed
+	}
+	return nil
+}
+
+// check checks the request to the agent, except the destination of UDP,
+// which is checked for each datagram.
+func (p *policy) check(a *agent, cmd byte, addrReq *depot.AddrReq) error {
+	if p == nil {
+		return nil
+	}
+
+	if len(p.times) != 0 {
+		now := time.Now()
+		ok := false
+		for i := range p.times {
+			if p.times[i].contains(now) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return errPolicyTime
+		}
+	}
+	if p.agents != nil && !p.agents[a.name] {
+		return errPolicyAgent
+	}
+	if cmd == socksCmdUDP {
+		return nil
+	}
+	return p.allowDest(addrReq)
+}
+
+// routeRequest routes the request of the user to an agent and checks it with
+// the user's policy. The policy checks the destination as the client asked
+// for it, before the domain of the agent is removed. The reply code is
+// returned if it fails.
+func routeRequest(bound, user string, cmd byte, addrReq *depot.AddrReq) (*agent,
+	*depot.AddrReq, *policy, byte, error) {
+	a, req, err := routeAgent(bound, user, addrReq)
+	if err != nil {
+		clog.Error("route request:", err)
+		return nil, nil, nil, depot.RepGeneralFailure, err
+	}
+	dbgLog.Println("route", addrReq, "to agent", a.name, "as", req)
+
+	p := userPolicy(user)
+	if err = p.check(a, cmd, addrReq); err != nil {
+		clog.Warn("refuse", user, "to", addrReq, "via", a.name+":", err)
+		return nil, nil, nil, depot.RepNotAllowed, err
+	}
+	return a, req, p, depot.RepSucceeded, nil
+}
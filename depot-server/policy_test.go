@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/choueric/depot"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	tests := []struct {
+		s    string
+		days string // 'x' for the days in the window, from Sunday
+		from int
+		to   int
+		fail bool
+	}{
+		{s: "Mon-Fri 09:00-18:00", days: ".xxxxx.", from: 9 * 60, to: 18 * 60},
+		{s: "Sat,Sun", days: "x.....x", to: 24 * 60},
+		{s: "Fri-Mon", days: "xx...xx", to: 24 * 60},
+		{s: "22:00-06:00", days: "xxxxxxx", from: 22 * 60, to: 6 * 60},
+		{s: "sun 00:00-24:00", days: "x......", to: 24 * 60},
+		{s: "Mon", days: ".x.....", to: 24 * 60},
+		{s: "", fail: true},
+		{s: "Mon 09:00 18:00", fail: true},
+		{s: "Someday", fail: true},
+		{s: "Mon 0900-1800", fail: true},
+		{s: "Mon 09:00", fail: true},
+		{s: "24:01-25:00", fail: true},
+		{s: "09:60-10:00", fail: true},
+	}
+	for _, tt := range tests {
+		w, err := parseTimeWindow(tt.s)
+		if (err != nil) != tt.fail {
+			t.Errorf("parseTimeWindow(%q) error = %v", tt.s, err)
+			continue
+		}
+		if tt.fail {
+			continue
+		}
+		days := ""
+		for _, d := range w.days {
+			if d {
+				days += "x"
+			} else {
+				days += "."
+			}
+		}
+		if days != tt.days || w.from != tt.from || w.to != tt.to {
+			t.Errorf("parseTimeWindow(%q) = %s %d-%d, want %s %d-%d", tt.s,
+				days, w.from, w.to, tt.days, tt.from, tt.to)
+		}
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	// 2024-01-01 is a Monday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, time.Local)
+	}
+	tests := []struct {
+		s  string
+		t  time.Time
+		in bool
+	}{
+		{"Mon-Fri 09:00-18:00", at(1, 9, 0), true},
+		{"Mon-Fri 09:00-18:00", at(1, 17, 59), true},
+		{"Mon-Fri 09:00-18:00", at(1, 18, 0), false},
+		{"Mon-Fri 09:00-18:00", at(6, 10, 0), false}, // Saturday
+		// crossing midnight, the morning belongs to the previous day
+		{"Fri 22:00-06:00", at(5, 23, 0), true},
+		{"Fri 22:00-06:00", at(6, 5, 59), true},
+		{"Fri 22:00-06:00", at(6, 6, 0), false},
+		{"Fri 22:00-06:00", at(5, 5, 0), false},
+		{"Sun 22:00-06:00", at(7, 23, 0), true},
+		{"Sun 22:00-06:00", at(8, 1, 0), true}, // Monday after Sunday
+		{"Sun 22:00-06:00", at(9, 1, 0), false},
+		{"Sat,Sun", at(7, 0, 0), true},
+		{"Sat,Sun", at(7, 23, 59), true},
+		{"Sat,Sun", at(8, 0, 0), false},
+	}
+	for _, tt := range tests {
+		w, err := parseTimeWindow(tt.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.contains(tt.t); got != tt.in {
+			t.Errorf("%q contains %v = %v, want %v", tt.s,
+				tt.t.Format("Mon 15:04"), got, tt.in)
+		}
+	}
+}
+
+func TestPolicyAllowDest(t *testing.T) {
+	p, err := newPolicy(&policyConfig{ACL: &depot.ACLConfig{
+		Default: "allow",
+		Rules: []depot.ACLRule{
+			{Action: "allow", Host: "nas", Ports: "9091"},
+			{Action: "deny", CIDR: "10.0.0.0/8"},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr  string
+		allow bool
+	}{
+		{"nas:9091", true},
+		{"10.1.1.1:80", false},
+		{"8.8.8.8:53", true},
+		// may resolve into 10.0.0.0/8
+		{"nas:22", false},
+		{"example.com:443", false},
+	}
+	for _, tt := range tests {
+		req, err := depot.NewAddrReqFromAddr(tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = p.allowDest(req); (err == nil) != tt.allow {
+			t.Errorf("allowDest(%s) = %v, want allowed %v", tt.addr, err, tt.allow)
+		}
+	}
+
+	var none *policy
+	if err := none.allowDest(&depot.AddrReq{Host: "any", Port: "1"}); err != nil {
+		t.Errorf("nil policy: %v", err)
+	}
+	noACL, err := newPolicy(&policyConfig{Agents: []string{"home"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := noACL.allowDest(&depot.AddrReq{Host: "any", Port: "1"}); err != nil {
+		t.Errorf("policy without acl: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+)
+
+// On SIGHUP, server reads the configuration file again. Credentials, ACLs,
+// users, rate limits, session caps, agents' routes and debug logging apply at
+// once, the listeners and TLS need restart. An invalid configuration is not
+// applied and server keeps running on the old one.
+
+// settings are what reload replaces. They are published together, as the
+// goroutines of sessions read them while reload runs.
+type settings struct {
+	config     *depot.Config
+	users      *userDB    // nil if users_file is not configured
+	reverseACL *depot.ACL // nil if reverse socks is disabled
+	// ports which locals can ask server to listen on
+	remotePorts depot.PortRanges
+}
+
+var current atomic.Value // *settings
+
+func getSettings() *settings           { return current.Load().(*settings) }
+func getConfig() *depot.Config         { return getSettings().config }
+func getUsers() *userDB                { return getSettings().users }
+func getReverseACL() *depot.ACL        { return getSettings().reverseACL }
+func getRemotePorts() depot.PortRanges { return getSettings().remotePorts }
+
+// serverFixed are the fields which need restart to change.
+var serverFixed = []string{"server_port", "control_port", "tunnel_port",
+	"allow_no_mux", "web_port", "http_port", "plaintext", "tls_cert", "tls_key",
+	"tls_ca", "tls_pins", "forwards"}
+
+// waitSignal reloads the configuration on SIGHUP, and returns after shutdown
+// on SIGTERM or SIGINT. A second SIGTERM or SIGINT exits at once.
+func waitSignal() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			clog.Printf("caught signal %v, shut down\n", sig)
+			go exitOnSignal(sigChan)
+			shutdown()
+			return
+		}
+		if err := reloadConfig(); err != nil {
+			clog.Error("reload configuration, keep the old one:", err)
+		}
+	}
+}
+
+func exitOnSignal(sigChan <-chan os.Signal) {
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			clog.Warn("caught signal", sig, "again, exit")
+			os.Exit(1)
+		}
+	}
+}
+
+func reloadConfig() error {
+	old := getSettings()
+	c, changed, err := old.config.Reload(serverFixed...)
+	if err != nil {
+		return err
+	}
+	ports, err := depot.ParsePorts(c.RemotePorts)
+	if err != nil {
+		return fmt.Errorf("remote_ports: %v", err)
+	}
+	racl, err := depot.NewACL(c.ReverseACL)
+	if err != nil {
+		return fmt.Errorf("reverse_acl: %v", err)
+	}
+	db := old.users
+	if c.UsersFile == "" {
+		db = nil
+	} else if db == nil || c.UsersFile != old.config.UsersFile {
+		if db, err = newUserDB(c.UsersFile); err != nil {
+			return fmt.Errorf("users: %v", err)
+		}
+	}
+	if err = checkLimits(&c.RateLimit); err != nil {
+		return fmt.Errorf("rate_limit: %v", err)
+	}
+	if err = checkWebAdmin(c.WebAdmin); err != nil {
+		return fmt.Errorf("web_admin: %v", err)
+	}
+
+	for _, name := range changed {
+		clog.Warn("reload:", name, "is changed, restart to apply it")
+	}
+	for _, ac := range c.Agents {
+		if oc := configAgent(old.config, ac.Name); ac.SocksPort != 0 &&
+			(oc == nil || oc.SocksPort != ac.SocksPort) {
+			clog.Warn("reload: socks_port of agent", ac.Name,
+				"is changed, restart to apply it")
+		}
+	}
+
+	current.Store(&settings{config: c, users: db, reverseACL: racl,
+		remotePorts: ports})
+	depot.SetDebug(c.Debug)
+	c.ApplyTimeout()
+	initLimits(&c.RateLimit)
+	clog.Printf("reload configuration from %s\n", c.Path())
+	return nil
+}
+
+// configAgent returns the configuration of agent name in c, nil if none.
+func configAgent(c *depot.Config, name string) *depot.AgentConfig {
+	for i := range c.Agents {
+		if c.Agents[i].Name == name {
+			return &c.Agents[i]
+		}
+	}
+	return nil
+}
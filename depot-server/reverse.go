@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+)
+
+const reverseDialTimeout = 10 * time.Second
+
+// acceptReverse serves the streams opened by local for its reverse socks
+// clients, until the control connection is closed. New streams are refused
+// at shutdown.
+func acceptReverse(a *agent) {
+	for {
+		stream, err := a.session.Accept()
+		if err != nil {
+			return
+		}
+		if isShuttingDown() {
+			stream.Close()
+			continue
+		}
+		go handleReverseStream(a, stream)
+	}
+}
+
+// handleReverseStream connects to the address in OPEN from local, and pipes
+// it with the stream.
+func handleReverseStream(a *agent, stream *depot.Stream) (err error) {
+	depot.SetReadTimeout(stream)
+	open := new(depot.Open)
+	if err = depot.ExpectMsg(stream, depot.MsgOpen, open); err != nil {
+		stream.Close()
+		return err
+	}
+
+	result := depot.OpenResult{ID: open.ID}
+	fail := func(rep byte, err error) error {
+		clog.Error("reverse socks of", a.name+":", err)
+		result.Rep = rep
+		result.Error = err.Error()
+		depot.WriteMsg(stream, depot.MsgOpenResult, &result)
+		stream.Close()
+		return err
+	}
+
+	reverseACL := getReverseACL()
+	if reverseACL == nil {
+		return fail(depot.RepNotAllowed, errors.New("reverse socks is disabled"))
+	}
+	if open.Cmd != depot.CmdConnect {
+		return fail(depot.RepCmdNotSupported, depot.ErrSocksCmd)
+	}
+	addrReq, err := depot.NewReqAddr(open.Addr)
+	if err != nil {
+		return fail(depot.RepAddrTypeUnsupported, err)
+	}
+	dbgLog.Println("reverse request of", a.name, "to", addrReq)
+
+	s := newSession("reverse", stream.RemoteAddr(), "", addrReq)
+	s.setAgent(a)
+	defer func() { s.close(err) }()
+	if err = s.admit(); err != nil {
+		return fail(depot.RepGeneralFailure, err)
+	}
+
+	addr, err := reverseACL.Check(addrReq)
+	if err != nil {
+		return fail(depot.DialErrorRep(err), err)
+	}
+	conn, err := net.DialTimeout("tcp", addr, reverseDialTimeout)
+	if err != nil {
+		return fail(depot.DialErrorRep(err), err)
+	}
+	if bind, err := depot.NewAddrReqFromAddr(conn.LocalAddr().String()); err == nil {
+		result.Bind = bind.Raw
+	}
+	conn = s.count(conn)
+	if err = depot.WriteMsg(stream, depot.MsgOpenResult, &result); err != nil {
+		conn.Close()
+		stream.Close()
+		return err
+	}
+
+	go depot.PipeThenClose(stream, conn)
+	depot.PipeThenClose(conn, stream)
+	dbgLog.Println("closed reverse connection to", addrReq)
+	return nil
+}
@@ -1,58 +1,212 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"flag"
-	"io"
+	"fmt"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/choueric/clog"
 	"github.com/choueric/depot"
 )
 
-type controlInfo struct {
-	ctrlConn   net.Conn
-	tunnelChan chan net.Conn
-}
+const (
+	tunnelWaitTimeout = 10 * time.Second
+	authNonceWindow   = 10 * time.Minute
+)
 
 var (
 	debug      = true
 	dbgLog     = depot.SetDebug(debug)
 	configFile = depot.GetDefaultConfigPath()
-	config     *depot.Config
 	listenAddr string
-	ctrlInfo   controlInfo
+	tlsConfig  *tls.Config // for control and tunnel, nil if plaintext
+	pendingMu  sync.Mutex
+	pending    = make(map[uint32]chan net.Conn) // requests waiting for tunnel
+	nonceCache = depot.NewNonceCache(authNonceWindow)
 )
 
-func initialCtrlInfo(conn net.Conn) {
-	ctrlInfo.ctrlConn = conn
-	ctrlInfo.tunnelChan = make(chan net.Conn)
+// newSessionID returns a random ID for the tunnel, which can't be guessed
+// by others connecting to the tunnel port. 0 is for the control connection.
+func newSessionID() uint32 {
+	var b [4]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		id := binary.BigEndian.Uint32(b[:])
+		pendingMu.Lock()
+		_, used := pending[id]
+		pendingMu.Unlock()
+		if id != 0 && !used {
+			return id
+		}
+	}
 }
 
-func clearCtrlInfo() {
-	ctrlInfo.ctrlConn = nil
-	ctrlInfo.tunnelChan = nil
+// addPending registers a request, the tunnel for it will be sent to the
+// returned channel.
+func addPending(id uint32) chan net.Conn {
+	ch := make(chan net.Conn, 1)
+	pendingMu.Lock()
+	pending[id] = ch
+	pendingMu.Unlock()
+	return ch
 }
 
-func controlHandshake(conn net.Conn) (err error) {
-	buf := make([]byte, len(depot.TunnelHelloMsg))
+// removePending unregisters a request and closes the tunnel which arrived
+// too late.
+func removePending(id uint32, ch chan net.Conn) {
+	pendingMu.Lock()
+	delete(pending, id)
+	pendingMu.Unlock()
+	select {
+	case conn := <-ch:
+		conn.Close()
+	default:
+	}
+}
+
+// deliverTunnel hands the tunnel to the request with the same ID.
+func deliverTunnel(id uint32, conn net.Conn) bool {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	ch, ok := pending[id]
+	if !ok {
+		return false
+	}
+	delete(pending, id)
+	ch <- conn
+	return true
+}
+
+// controlHandshake checks local's hello and registers it as an agent. All
+// tunnels of the agent are multiplexed over the control connection if both
+// sides can.
+func controlHandshake(conn net.Conn) (*agent, error) {
 	depot.SetReadTimeout(conn)
-	if _, err := io.ReadFull(conn, buf); err != nil {
-		return err
+	var hello depot.Hello
+	if err := depot.ExpectMsg(conn, depot.MsgHello, &hello); err != nil {
+		handshakeFailures.inc("agent_hello")
+		return nil, err
+	}
+	if hello.Name == "" {
+		hello.Name = depot.DefaultAgentName
+	}
+	dbgLog.Println("local hello:", hello.Name, hello.Version, hello.Caps)
+
+	refuse := func(reason string, err error) (*agent, error) {
+		handshakeFailures.inc(reason)
+		depot.WriteMsg(conn, depot.MsgError, &depot.Error{Reason: err.Error()})
+		return nil, err
+	}
+	if hello.Version != depot.ProtoVersion {
+		return refuse("agent_version", fmt.Errorf(
+			"protocol version %d is not supported, need %d",
+			hello.Version, depot.ProtoVersion))
+	}
+	if !hello.HasCap(depot.CapMux) && !getConfig().AllowNoMux {
+		return refuse("agent_no_mux",
+			errors.New("locals without mux are not allowed, set allow_no_mux on server"))
+	}
+	ack := depot.Hello{Version: depot.ProtoVersion}
+	if key := getConfig().SharedKey; key != "" {
+		nonce, err := authenticateLocal(conn, &hello, key)
+		if err != nil {
+			return refuse("agent_auth", err)
+		}
+		ack.Proof = depot.AuthMAC(key, depot.AuthServer,
+			hello.Nonce, nonce, hello.Name)
+	} else if hello.HasCap(depot.CapAuth) {
+		return refuse("agent_auth",
+			errors.New("auth: no shared_key configured on server"))
+	}
+	if findAgent(hello.Name) != nil {
+		return refuse("agent_duplicate",
+			errors.New("agent "+hello.Name+" is already connected"))
+	}
+	if hello.HasCap(depot.CapMux) {
+		ack.Caps = append(ack.Caps, depot.CapMux)
+		if getReverseACL() != nil {
+			ack.Caps = append(ack.Caps, depot.CapReverse)
+		}
+	}
+	if hello.HasCap(depot.CapHeartbeat) {
+		ack.Caps = append(ack.Caps, depot.CapHeartbeat)
+	}
+	if err := depot.WriteMsg(conn, depot.MsgHelloAck, &ack); err != nil {
+		return nil, err
+	}
+	// the control connection is idle between messages, its liveness is
+	// checked by heartbeats instead
+	conn.SetReadDeadline(time.Time{})
+
+	a := newAgent(hello.Name, conn, ack.HasCap(depot.CapMux),
+		ack.HasCap(depot.CapHeartbeat))
+	if err := registerAgent(a); err != nil {
+		handshakeFailures.inc("agent_duplicate")
+		a.close()
+		return nil, err
+	}
+	agentConnects.inc(a.name)
+	return a, nil
+}
+
+// authenticateLocal challenges local to prove it knows the shared key, and
+// returns the nonce of the challenge.
+func authenticateLocal(conn net.Conn, hello *depot.Hello, key string) ([]byte, error) {
+	if !nonceCache.Check(hello.Nonce) {
+		return nil, errors.New("auth: invalid or replayed nonce")
 	}
 
-	if depot.TunnelHelloMsg != string(buf) {
-		return errors.New("tunnel: wrong hello msg")
+	nonce := depot.NewNonce()
+	err := depot.WriteMsg(conn, depot.MsgChallenge, &depot.Challenge{Nonce: nonce})
+	if err != nil {
+		return nil, err
 	}
-	conn.Write([]byte(depot.TunnelReplyMsg))
 
-	return nil
+	var auth depot.Auth
+	if err := depot.ExpectMsg(conn, depot.MsgAuth, &auth); err != nil {
+		return nil, fmt.Errorf("auth: %v", err)
+	}
+	mac := depot.AuthMAC(key, depot.AuthLocal, nonce, hello.Nonce,
+		hello.Name)
+	if !depot.CheckMAC(mac, auth.MAC) {
+		return nil, errors.New("auth: wrong shared key")
+	}
+	return nonce, nil
 }
 
+// handleTunnelConn reads the session ID echoed by local and passes the tunnel
+// to the request waiting for it. With the shared key, local must prove it
+// knows the key.
 func handleTunnelConn(conn net.Conn) {
 	dbgLog.Println("tunnel connection:", conn.RemoteAddr())
-	ctrlInfo.tunnelChan <- conn
+	depot.SetReadTimeout(conn)
+	var tunnel depot.Tunnel
+	if err := depot.ExpectMsg(conn, depot.MsgTunnel, &tunnel); err != nil {
+		clog.Error("read tunnel handshake:", err)
+		conn.Close()
+		return
+	}
+	if key := getConfig().SharedKey; key != "" &&
+		!depot.CheckMAC(depot.TunnelMAC(key, tunnel.ID), tunnel.MAC) {
+		handshakeFailures.inc("tunnel_auth")
+		clog.Warn("refuse tunnel from", conn.RemoteAddr(), "- auth: wrong shared key")
+		conn.Close()
+		return
+	}
+
+	if !deliverTunnel(tunnel.ID, conn) {
+		clog.Warn("no request for tunnel", tunnel.ID)
+		conn.Close()
+	}
 }
 
 func listen(host, port, name string) (net.Listener, error) {
@@ -65,37 +219,60 @@ func listen(host, port, name string) (net.Listener, error) {
 	return ln, nil
 }
 
-func serveSocks5(host, port string) {
+// serveSocks5 serves socks clients on the port. If agent is not empty, all
+// sessions on the port go to that agent.
+func serveSocks5(host, port, agent string) {
 	socksLn, err := listen(host, port, "socks5")
 	if err != nil {
 		clog.Fatal("socks5", err)
 	}
+	trackListener(socksLn)
 
 	for {
 		dbgLog.Println("Wait on socks port ...")
 		conn, err := socksLn.Accept()
 		if err != nil {
+			if isShuttingDown() {
+				return
+			}
 			clog.Error("accept socks5:", err)
 			continue
 		}
 
-		if ctrlInfo.ctrlConn == nil {
+		if numAgents() == 0 {
 			conn.Close()
 			clog.Warn("no control connection yet")
 			continue
 		}
 
-		go handleSocks5Conn(conn)
+		go handleSocksConn(conn, agent)
+	}
+}
+
+// listenLink listens for control or tunnel connections of local.
+func listenLink(host, port, name string) (net.Listener, error) {
+	ln, err := listen(host, port, name)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		clog.Warn(name, "connections are not encrypted")
+		return ln, nil
 	}
+	return tls.NewListener(ln, tlsConfig), nil
 }
 
-func serveTunnel(tunnelLn net.Listener, done <-chan struct{}) {
+func serveTunnel(host, port string) {
+	tunnelLn, err := listenLink(host, port, "tunnel")
+	if err != nil {
+		clog.Fatal("tunnel", err)
+	}
+	trackListener(tunnelLn)
+
 	for {
 		conn, err := tunnelLn.Accept()
 		if err != nil {
-			select {
-			case <-done:
-				dbgLog.Warn("tunnel listener is done")
+			if isShuttingDown() {
 				return
 			}
 			clog.Error("tunnel accept:", err)
@@ -105,49 +282,122 @@ func serveTunnel(tunnelLn net.Listener, done <-chan struct{}) {
 	}
 }
 
-func serveControl(host, ctrlPort, tunnelPort string) {
-	ctrlLn, err := listen(host, ctrlPort, "control")
+// handleControl reads messages from local until the control connection is
+// down or closed by local.
+func handleControl(a *agent) error {
+	ctrlConn := a.control()
+	for {
+		msg, err := depot.ReadMsg(ctrlConn)
+		if err != nil {
+			return err
+		}
+
+		switch msg.Type {
+		case depot.MsgPing:
+			var ping depot.Ping
+			if err := msg.Decode(&ping); err != nil {
+				return err
+			}
+			if ping.RTT > 0 {
+				a.setRTT(time.Duration(ping.RTT) * time.Microsecond)
+			}
+			if err := depot.WriteMsg(ctrlConn, depot.MsgPong, &ping); err != nil {
+				return err
+			}
+		case depot.MsgPong:
+			var pong depot.Ping
+			if err := msg.Decode(&pong); err != nil {
+				return err
+			}
+			if a.beat != nil {
+				a.beat.Pong(&pong)
+			}
+		case depot.MsgClose:
+			var c depot.Close
+			if err := msg.Decode(&c); err != nil {
+				return err
+			}
+			if c.ID == 0 {
+				return errors.New("closed by local: " + c.Reason)
+			}
+			dbgLog.Println("local closed session", c.ID, c.Reason)
+		case depot.MsgShutdown:
+			var sd depot.Shutdown
+			if err := msg.Decode(&sd); err != nil {
+				return err
+			}
+			a.setDraining()
+			clog.Printf("agent %s is shutting down, drain %d seconds\n", a.name,
+				sd.Drain)
+		case depot.MsgForward:
+			var f depot.Forward
+			if err := msg.Decode(&f); err != nil {
+				return err
+			}
+			result := depot.ForwardResult{Port: f.Port}
+			if err := a.addForward(&f); err != nil {
+				clog.Error("remote forward of", a.name+":", err)
+				result.Error = err.Error()
+			}
+			if err := depot.WriteMsg(ctrlConn, depot.MsgForwardResult, &result); err != nil {
+				return err
+			}
+		case depot.MsgError:
+			var e depot.Error
+			if err := msg.Decode(&e); err != nil {
+				return err
+			}
+			return errors.New("local error: " + e.Reason)
+		default:
+			dbgLog.Println("ignore control message", msg)
+		}
+	}
+}
+
+func handleControlConn(ctrlConn net.Conn) {
+	dbgLog.Println("control connection:", ctrlConn.RemoteAddr())
+
+	a, err := controlHandshake(ctrlConn)
+	if err != nil {
+		clog.Error("control handshake:", err)
+		ctrlConn.Close()
+		return
+	}
+	clog.Printf("agent %s connected from %v\n", a.name, ctrlConn.RemoteAddr())
+	if a.session != nil {
+		go acceptReverse(a)
+	}
+	done := make(chan struct{})
+	if a.beat != nil {
+		go a.sayAlive(done)
+	}
+
+	err = handleControl(a)
+	close(done)
+
+	unregisterAgent(a)
+	a.close()
+	dbgLog.Warn("agent ", a.name, " ", ctrlConn.RemoteAddr(), " is dead: ", err)
+}
+
+func serveControl(host, port string) {
+	ctrlLn, err := listenLink(host, port, "control")
 	if err != nil {
 		clog.Fatal("control", err)
 	}
+	trackListener(ctrlLn)
 
 	for {
 		dbgLog.Println("Wait on control port ...")
 		ctrlConn, err := ctrlLn.Accept()
 		if err != nil {
+			if isShuttingDown() {
+				return
+			}
 			clog.Error("accept control: ", err)
 			continue
 		}
-		dbgLog.Println("control connection:", ctrlConn.RemoteAddr())
-
-		if err := controlHandshake(ctrlConn); err != nil {
-			ctrlConn.Close()
-			continue
-		}
-
-		tunnelLn, err := listen(host, tunnelPort, "tunnel")
-		if err != nil {
-			clog.Error("listen tunnel", err)
-			ctrlConn.Close()
-			continue
-		}
-
-		initialCtrlInfo(ctrlConn)
-		done := make(chan struct{})
-		go serveTunnel(tunnelLn, done)
-
-		for {
-			buf := make([]byte, len(depot.TunnelAliveMsg))
-			_, err := io.ReadFull(ctrlConn, buf)
-			if err != nil {
-				close(done)
-				tunnelLn.Close()
-				ctrlConn.Close()
-				clearCtrlInfo()
-				dbgLog.Warn(ctrlConn.RemoteAddr(), " is dead\n")
-				break
-			}
-		}
+		go handleControlConn(ctrlConn)
 	}
 }
 
@@ -157,22 +407,72 @@ func init() {
 	flag.StringVar(&configFile, "c", configFile, "specify config file")
 	flag.StringVar(&listenAddr, "a", "",
 		"local address, listen only to this address if specified")
-	flag.Parse()
+	flag.BoolVar(&hashPassword, "hash", false,
+		"read a password from stdin and print its hash for the users file")
 }
 
 func main() {
-	c, err := depot.GetConfig(configFile)
+	flag.Parse()
+	if hashPassword {
+		if err := printHash(); err != nil {
+			clog.Fatal(err)
+		}
+		return
+	}
+
+	config, err := depot.GetConfig(configFile)
 	if err != nil {
 		clog.Fatal(err)
 	}
-	config = c
-	dbgLog = depot.SetDebug(config.Debug)
+	depot.SetDebug(config.Debug)
 	clog.Printf("depot-server [%v]\n", depot.VERSION)
 
+	if tlsConfig, err = config.ServerTLSConfig(); err != nil {
+		clog.Fatal("tls:", err)
+	}
+	s := &settings{config: config}
+	if s.remotePorts, err = depot.ParsePorts(config.RemotePorts); err != nil {
+		clog.Fatal("remote_ports:", err)
+	}
+	if s.reverseACL, err = depot.NewACL(config.ReverseACL); err != nil {
+		clog.Fatal("reverse_acl:", err)
+	}
+	if config.UsersFile != "" {
+		if s.users, err = newUserDB(config.UsersFile); err != nil {
+			clog.Fatal("users:", err)
+		}
+	}
+	if err = initLimits(&config.RateLimit); err != nil {
+		clog.Fatal("rate_limit:", err)
+	}
+	if err = checkWebAdmin(config.WebAdmin); err != nil {
+		clog.Fatal("web_admin:", err)
+	}
+	current.Store(s)
+	go sampleRates()
+
 	if config.WebPort != 0 {
 		go serveWeb(listenAddr, strconv.Itoa(config.WebPort))
 	}
-	go serveControl(listenAddr, strconv.Itoa(config.ControlPort),
-		strconv.Itoa(config.TunnelPort))
-	serveSocks5(listenAddr, strconv.Itoa(config.ServerPort))
+	if config.AllowNoMux && config.TunnelPort != 0 {
+		go serveTunnel(listenAddr, strconv.Itoa(config.TunnelPort))
+	}
+	for _, ac := range config.Agents {
+		if ac.SocksPort != 0 {
+			go serveSocks5(listenAddr, strconv.Itoa(ac.SocksPort), ac.Name)
+		}
+	}
+	if config.HTTPPort != 0 {
+		go serveHTTP(listenAddr, strconv.Itoa(config.HTTPPort))
+	}
+	for _, fc := range config.Forwards {
+		addrReq, err := depot.NewAddrReqFromAddr(fc.Target)
+		if err != nil {
+			clog.Fatal("forward", fc.Port, "target:", err)
+		}
+		go serveForward(listenAddr, strconv.Itoa(fc.Port), fc.Agent, addrReq)
+	}
+	go serveControl(listenAddr, strconv.Itoa(config.ControlPort))
+	go serveSocks5(listenAddr, strconv.Itoa(config.ServerPort), "")
+	waitSignal()
 }
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/choueric/depot"
+)
+
+const (
+	// sessionHistory is the number of closed sessions kept for the web page.
+	sessionHistory = 100
+	// rateInterval is how often the throughput of sessions is calculated.
+	rateInterval = 2 * time.Second
+)
+
+// session is a client connection served by server, from the socks, HTTP
+// proxy and forward ports, or a reverse socks connection of local.
+type session struct {
+	up   int64 // bytes sent to the target, accessed atomically
+	down int64 // bytes received from the target, accessed atomically
+
+	id     uint64
+	kind   string // e.g. "socks5", "socks5 udp", "http connect", "forward"
+	client string
+	user   string
+	target string
+	start  time.Time
+	limit  *limiterPair // of this session only
+
+	// limiters to wait for, set when the connection to target is counted
+	limiters []*limiterPair
+
+	mu     sync.Mutex
+	agent  string
+	reason string // why the session is closed
+	end    time.Time
+	slots  map[slotKey]int // taken by admit
+	conn   net.Conn        // to the target, closed to abort the session
+
+	// bytes at sampleTime, to calculate the throughput by sampleRates
+	sampleTime           time.Time
+	sampleUp, sampleDown int64
+	rateUp, rateDown     float64
+}
+
+// sessionStat is a snapshot of the session.
+type sessionStat struct {
+	ID       uint64     `json:"id"`
+	Kind     string     `json:"kind"`
+	Client   string     `json:"client"`
+	User     string     `json:"user"`
+	Target   string     `json:"target"`
+	Agent    string     `json:"agent"`
+	Start    time.Time  `json:"start"`
+	End      *time.Time `json:"end,omitempty"` // nil if active
+	Up       int64      `json:"up"`
+	Down     int64      `json:"down"`
+	RateUp   float64    `json:"rate_up"` // bytes per second
+	RateDown float64    `json:"rate_down"`
+	// the lowest rate limit of the session, 0 if no limit
+	RateLimit int64  `json:"rate_limit"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+var errSessionNotFound = errors.New("session not found")
+
+var (
+	sessionsMu     sync.Mutex
+	sessions       = make(map[uint64]*session)
+	closedSessions []*session // oldest first
+	lastSessionID  uint64
+)
+
+// sessionKind returns the kind of the session for socks command cmd.
+func sessionKind(proto string, cmd byte) string {
+	switch cmd {
+	case socksCmdBind:
+		return proto + " bind"
+	case socksCmdUDP:
+		return proto + " udp"
+	}
+	return proto
+}
+
+// newSession registers a session of the client to target.
+func newSession(kind string, client net.Addr, user string,
+	target *depot.AddrReq) *session {
+	now := time.Now()
+	s := &session{
+		id:         atomic.AddUint64(&lastSessionID, 1),
+		kind:       kind,
+		client:     client.String(),
+		user:       user,
+		target:     target.String(),
+		start:      now,
+		limit:      newSessionLimit(),
+		sampleTime: now,
+	}
+
+	sessionsMu.Lock()
+	sessions[s.id] = s
+	sessionsMu.Unlock()
+	return s
+}
+
+func (s *session) setAgent(a *agent) {
+	s.mu.Lock()
+	s.agent = a.name
+	s.mu.Unlock()
+}
+
+// setReason records why the session is closed, the first reason wins.
+func (s *session) setReason(reason string) {
+	s.mu.Lock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+	s.mu.Unlock()
+}
+
+// close unregisters the session and keeps it in the history. err is the
+// reason if it's not nil.
+func (s *session) close(err error) {
+	s.mu.Lock()
+	if err != nil {
+		s.reason = err.Error()
+	} else if s.reason == "" {
+		s.reason = "closed"
+	}
+	s.end = time.Now()
+	slots := s.slots
+	s.slots = nil
+	s.mu.Unlock()
+	releaseSlots(slots)
+	sessionResults.inc(sessionResult(err))
+
+	sessionsMu.Lock()
+	delete(sessions, s.id)
+	closedSessions = append(closedSessions, s)
+	if len(closedSessions) > sessionHistory {
+		closedSessions = closedSessions[len(closedSessions)-sessionHistory:]
+	}
+	sessionsMu.Unlock()
+}
+
+// sample calculates the throughput since the last sample.
+func (s *session) sample(now time.Time) {
+	up := atomic.LoadInt64(&s.up)
+	down := atomic.LoadInt64(&s.down)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d := now.Sub(s.sampleTime); d > 0 {
+		s.rateUp = float64(up-s.sampleUp) / d.Seconds()
+		s.rateDown = float64(down-s.sampleDown) / d.Seconds()
+		s.sampleTime, s.sampleUp, s.sampleDown = now, up, down
+	}
+}
+
+// sampleRates calculates the throughput of the active sessions every
+// rateInterval, so it doesn't depend on how often they are watched.
+func sampleRates() {
+	for now := range time.Tick(rateInterval) {
+		sessionsMu.Lock()
+		list := make([]*session, 0, len(sessions))
+		for _, s := range sessions {
+			list = append(list, s)
+		}
+		sessionsMu.Unlock()
+
+		for _, s := range list {
+			s.sample(now)
+		}
+	}
+}
+
+func (s *session) stat() sessionStat {
+	up := atomic.LoadInt64(&s.up)
+	down := atomic.LoadInt64(&s.down)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := sessionStat{
+		ID:     s.id,
+		Kind:   s.kind,
+		Client: s.client,
+		User:   s.user,
+		Target: s.target,
+		Agent:  s.agent,
+		Start:  s.start,
+		Up:     up,
+		Down:   down,
+		Reason: s.reason,
+	}
+	if s.end.IsZero() {
+		st.RateUp, st.RateDown = s.rateUp, s.rateDown
+	}
+	for _, p := range s.limiters {
+		if rate := p.rate(); rate != 0 && (st.RateLimit == 0 || rate < st.RateLimit) {
+			st.RateLimit = rate
+		}
+	}
+	if !s.end.IsZero() {
+		end := s.end
+		st.End = &end
+	}
+	return st
+}
+
+// count returns the connection to the target which counts the bytes of the
+// session and its agent, limits the rate, and records why it's closed.
+func (s *session) count(conn net.Conn) net.Conn {
+	s.mu.Lock()
+	agent := s.agent
+	s.mu.Unlock()
+
+	limiters := []*limiterPair{globalLimit, agentLimit(agent), s.limit}
+	if s.user != "" {
+		limiters = append(limiters, userLimit(s.user))
+	}
+	s.mu.Lock()
+	s.limiters = limiters
+	s.conn = conn
+	s.mu.Unlock()
+	return &countedConn{conn, s, agentTraffic(agent), limiters}
+}
+
+type countedConn struct {
+	net.Conn
+	s        *session
+	t        *traffic
+	limiters []*limiterPair
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.s.down, int64(n))
+	atomic.AddUint64(&c.t.down, uint64(n))
+	for _, p := range c.limiters {
+		p.down.Wait(n)
+	}
+	if err != nil {
+		if err == io.EOF {
+			c.s.setReason("closed by target")
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			c.s.setReason("idle timeout")
+		} else {
+			c.s.setReason(err.Error())
+		}
+	}
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	for _, p := range c.limiters {
+		p.up.Wait(len(b))
+	}
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.s.up, int64(n))
+	atomic.AddUint64(&c.t.up, uint64(n))
+	return n, err
+}
+
+// Close is called when the client side is done, unless the target is closed
+// first.
+func (c *countedConn) Close() error {
+	c.s.setReason("closed by client")
+	return c.Conn.Close()
+}
+
+func numSessions() int {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	return len(sessions)
+}
+
+// abortSessions closes the connections of the active sessions for reason, and
+// returns how many are closed.
+func abortSessions(reason string) int {
+	sessionsMu.Lock()
+	list := make([]*session, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, s)
+	}
+	sessionsMu.Unlock()
+
+	for _, s := range list {
+		s.setReason(reason)
+		s.mu.Lock()
+		conn := s.conn
+		s.mu.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	return len(list)
+}
+
+// listSessions returns the active sessions sorted by ID.
+func listSessions() []sessionStat {
+	sessionsMu.Lock()
+	list := make([]*session, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, s)
+	}
+	sessionsMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	stats := make([]sessionStat, len(list))
+	for i, s := range list {
+		stats[i] = s.stat()
+	}
+	return stats
+}
+
+// activeSession returns the active session of the id, nil if not found.
+func activeSession(id uint64) *session {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	return sessions[id]
+}
+
+// findSession returns the active or closed session of the id.
+func findSession(id uint64) (sessionStat, bool) {
+	sessionsMu.Lock()
+	s := sessions[id]
+	if s == nil {
+		for _, c := range closedSessions {
+			if c.id == id {
+				s = c
+				break
+			}
+		}
+	}
+	sessionsMu.Unlock()
+
+	if s == nil {
+		return sessionStat{}, false
+	}
+	return s.stat(), true
+}
+
+// listClosedSessions returns the closed sessions in history, the latest
+// first.
+func listClosedSessions() []sessionStat {
+	sessionsMu.Lock()
+	list := make([]*session, len(closedSessions))
+	copy(list, closedSessions)
+	sessionsMu.Unlock()
+
+	stats := make([]sessionStat, len(list))
+	for i, s := range list {
+		stats[len(list)-1-i] = s.stat()
+	}
+	return stats
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionRates(t *testing.T) {
+	start := time.Now()
+	s := &session{start: start, sampleTime: start}
+	s.up, s.down = 2000, 4000
+	s.sample(start.Add(2 * time.Second))
+
+	// watching the session doesn't change its throughput
+	for i := 0; i < 3; i++ {
+		st := s.stat()
+		if st.RateUp != 1000 || st.RateDown != 2000 {
+			t.Fatalf("rates = %v up, %v down, want 1000 up, 2000 down",
+				st.RateUp, st.RateDown)
+		}
+	}
+
+	s.sample(start.Add(4 * time.Second))
+	if st := s.stat(); st.RateUp != 0 || st.RateDown != 0 {
+		t.Errorf("rates of an idle session = %v, %v, want 0", st.RateUp,
+			st.RateDown)
+	}
+
+	s.up = 3000
+	s.sample(start.Add(5 * time.Second))
+	s.end = start.Add(5 * time.Second)
+	if st := s.stat(); st.RateUp != 0 || st.End == nil {
+		t.Errorf("closed session: rate = %v, end = %v", st.RateUp, st.End)
+	}
+}
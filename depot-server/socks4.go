@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+)
+
+const (
+	socksVer4        = 4
+	socks4Granted    = 90
+	socks4Rejected   = 91
+	socks4MaxField   = 255 // max length of USERID and domain
+	socks4ReplyVer   = 0
+	socks4HeaderSize = 8
+)
+
+var errSocks4Field = errors.New("socks4 field too long")
+
+/*
+client:
+   +----+----+----------+--------+----------+------+----------+------+
+   | VN | CD | DST.PORT | DST.IP |  USERID  | NULL |  DOMAIN  | NULL |
+   +----+----+----------+--------+----------+------+----------+------+
+   | 1  | 1  |    2     |   4    | Variable |  1   | Variable |  1   |
+   +----+----+----------+--------+----------+------+----------+------+
+
+VN: 0x04
+CD: 1 for CONNECT, 2 for BIND
+DOMAIN: only for socks4a, whose DST.IP is 0.0.0.x and x is not zero.
+
+server:
+   +----+----+----------+--------+
+   | VN | CD | DST.PORT | DST.IP |
+   +----+----+----------+--------+
+   | 1  | 1  |    2     |   4    |
+   +----+----+----------+--------+
+
+VN: 0x00
+CD: 90 for granted, 91 for rejected or failed.
+*/
+
+// readString reads a string ended by NULL. It's read byte by byte, so the
+// data sent after the request is left in the connection.
+func readString(r io.Reader) (string, error) {
+	var b []byte
+	var c [1]byte
+	for {
+		if _, err := io.ReadFull(r, c[:]); err != nil {
+			return "", err
+		}
+		if c[0] == 0x00 {
+			return string(b), nil
+		}
+		if len(b) == socks4MaxField {
+			return "", errSocks4Field
+		}
+		b = append(b, c[0])
+	}
+}
+
+// socks4Request reads the request of socks4 client, and authenticates the
+// USERID as "name:password" if server has users.
+func socks4Request(conn net.Conn) (user string, cmd byte,
+	addrReq *depot.AddrReq, err error) {
+	depot.SetReadTimeout(conn)
+
+	var hdr [socks4HeaderSize]byte
+	if _, err = io.ReadFull(conn, hdr[:]); err != nil {
+		return
+	}
+	cmd = hdr[1]
+	port := binary.BigEndian.Uint16(hdr[2:4])
+	ip := net.IP(hdr[4:8])
+
+	userID, err := readString(conn)
+	if err != nil {
+		return
+	}
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 { // socks4a
+		if host, err = readString(conn); err != nil {
+			return
+		}
+	}
+
+	if getTargetMethod() == depot.METHOD_USERNAME {
+		name, password := userID, ""
+		if i := strings.Index(userID, ":"); i >= 0 {
+			name, password = userID[:i], userID[i+1:]
+		}
+		user = name
+		if err = checkUser(name, password); err != nil {
+			clog.Error("socks4 authenticate", name+":", err)
+			sendSocks4Reply(conn, depot.RepNotAllowed, nil)
+			return
+		}
+	}
+
+	if cmd != socksCmdConnect && cmd != socksCmdBind {
+		err = depot.ErrSocksCmd
+		sendSocks4Reply(conn, depot.RepCmdNotSupported, nil)
+		return
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if addrReq, err = depot.NewAddrReqFromAddr(addr); err != nil {
+		sendSocks4Reply(conn, depot.RepAddrTypeUnsupported, nil)
+	}
+	return
+}
+
+// sendSocks4Reply sends the reply of socks5 code rep to socks4 client. The
+// bound address is sent if it's ipv4.
+func sendSocks4Reply(conn net.Conn, rep byte, bind []byte) error {
+	reply := make([]byte, socks4HeaderSize)
+	reply[0] = socks4ReplyVer
+	reply[1] = socks4Rejected
+	if rep == depot.RepSucceeded {
+		reply[1] = socks4Granted
+	}
+	if len(bind) == 1+net.IPv4len+2 && bind[0] == depot.ATYP_IPV4 {
+		copy(reply[2:4], bind[1+net.IPv4len:])
+		copy(reply[4:8], bind[1:1+net.IPv4len])
+	}
+	_, err := conn.Write(reply)
+	return err
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"time"
 
 	"github.com/choueric/clog"
 	"github.com/choueric/depot"
@@ -13,299 +15,224 @@ import (
 const (
 	socksVer5       = 5
 	socksCmdConnect = 1
-
-	VER             = 0
-	NMETHODS        = 1
-	METHODS         = 2
-	ULEN            = 1
-	UNAME           = 2
-	METHOD_NONE     = 0x00
-	METHOD_GSSAPI   = 0x01
-	METHOD_USERNAME = 0x02
-	METHOD_IANA     = 0x03 // 0x03 - 0x7f
-	METHOD_RSV      = 0x80 // 0x80 - 0xfe, reserve for private methods
-	METHOD_DENY     = 0xff // no acceptable methods
-	CMD             = 1
-	ATYP            = 3 // address type index
-	DST_ADDR        = 4 // ip addres start index
-	DOMAIN_LEN      = 4 // domain address length index
-	DOMAIN_ADDR     = 5 // domain address start index
-	ATYP_IPV4       = 1 // type is ipv4 address
-	ATYP_DOMAIN     = 3 // type is domain address
-	ATYP_IPV6       = 4 // type is ipv6 address
-)
-
-var (
-	errVer           = errors.New("socks version not supported")
-	errMethod        = errors.New("socks only support user/password method now")
-	errAuthExtraData = errors.New("socks authentication get extra data")
-	errAuth          = errors.New("socks invalid username/password")
-	errReqExtraData  = errors.New("socks request get extra data")
-	errCmd           = errors.New("socks only support CONNECT request")
-	errAddrType      = errors.New("socks invalid address type")
+	socksCmdBind    = 2
+	socksCmdUDP     = 3
 )
 
-func getTargetMethod(config *depot.Config) int {
-	if config.UserName == "" {
-		return METHOD_NONE
+func getTargetMethod() int {
+	if s := getSettings(); s.users == nil && s.config.UserName == "" {
+		return depot.METHOD_NONE
 	} else {
-		return METHOD_USERNAME
+		return depot.METHOD_USERNAME
 	}
 }
 
-/*
-client:
-  +----+----------+----------+
-  |VER | NMETHODS | METHODS  |
-  +----+----------+----------+
-  | 1  |    1     | 1 to 255 |
-  +----+----------+----------+
-server:
-  +----+--------+
-  |VER | METHOD |
-  +----+--------+
-  | 1  |   1    |
-  +----+--------+
-*/
-func socksHandShake(conn net.Conn) (err error) {
-	buf := make([]byte, 258)
-	depot.SetReadTimeout(conn)
-
-	var n int
-	// make sure we get the nmethod field
-	if n, err = io.ReadAtLeast(conn, buf, NMETHODS+1); err != nil {
-		return err
-	}
-	dbgLog.Printf("read %v bytes\n", buf[0:n])
-
-	if buf[VER] != socksVer5 {
-		return errVer
-	}
-
-	nmethod := int(buf[NMETHODS])
-	msgLen := nmethod + 2
-	if n == msgLen { // done, common case
-		// do nothing, jump directly to send confirmation
-	} else if n < msgLen { // has more methods to read, rare case
-		if _, err = io.ReadFull(conn, buf[n:msgLen]); err != nil {
-			return
-		}
-	} else { // error, should not get extra data
-		return errAuthExtraData
+// failureRep returns the reply code for a failed tunnel.
+func failureRep(result *depot.OpenResult) byte {
+	if result != nil {
+		return result.Rep
 	}
-
-	m := METHOD_DENY
-	targetMethod := getTargetMethod(config)
-	for i := METHODS; i < msgLen; i++ {
-		if int(buf[i]) == targetMethod {
-			m = METHOD_USERNAME
-			break
-		}
-	}
-
-	// send confirmation: version 5,
-	_, err = conn.Write([]byte{socksVer5, byte(m)})
-	if m == METHOD_DENY {
-		// authentication dosen't match
-		return errMethod
-	}
-	return nil
+	return depot.RepGeneralFailure
 }
 
-/*
-user/password sub-authentication
-+----+------+----------+------+----------+
-|VER | ULEN |   UNAME  | PLEN |  PASSWD  |
-+----+------+----------+------+----------+
-| 1  |   1  | 1 to 255 |  1   | 1 to 255 |
-+----+------+----------+------+----------+
-
-+----+--------+
-|VER | STATUS |
-+----+--------+
-| 1  |    1   |
-+----+--------+
-
-VER: 0x01
-STATUS: 0x00, sucess. others, fail
-*/
-func socksAuthticate(conn net.Conn) (err error) {
-	buf := make([]byte, 257) // 255 + 2
-	depot.SetReadTimeout(conn)
-
-	if _, err = io.ReadFull(conn, buf[0:2]); err != nil {
-		return err
-	}
-
-	if buf[VER] != 0x01 {
-		return errors.New("user/password sub-auth: invalid version")
+// getTunnel opens a tunnel to local for the request and waits until local
+// connected to the app. If local supports multiplexing, the tunnel is a new
+// stream on the control connection. Otherwise it sends request to local and
+// waits for local's new tunnel connection with the same session ID.
+// The result is nil if local did not report one.
+func getTunnel(a *agent, cmd byte, addrReq *depot.AddrReq) (net.Conn, *depot.OpenResult, error) {
+	open := &depot.Open{
+		ID:   newSessionID(),
+		Cmd:  cmd,
+		Addr: addrReq.Raw,
+	}
+
+	start := time.Now()
+	var tunnelConn net.Conn
+	var err error
+	if a.session != nil {
+		tunnelConn, err = getStreamTunnel(a.session, open)
+	} else {
+		tunnelConn, err = waitTunnel(a.ctrlConn, open)
 	}
-
-	ulen := int(buf[ULEN])
-	if _, err = io.ReadFull(conn, buf[0:ulen]); err != nil {
-		return
+	if err != nil {
+		return nil, nil, err
 	}
-	username := string(buf[0:ulen])
-	dbgLog.Println("username:", username)
 
-	if _, err = io.ReadFull(conn, buf[0:1]); err != nil {
-		return err
+	depot.SetReadTimeout(tunnelConn)
+	result := new(depot.OpenResult)
+	if err = depot.ExpectMsg(tunnelConn, depot.MsgOpenResult, result); err != nil {
+		tunnelConn.Close()
+		return nil, nil, err
 	}
-	plen := int(buf[0])
-	if _, err = io.ReadFull(conn, buf[0:plen]); err != nil {
-		return
+	tunnelSetup.observe(time.Since(start).Seconds())
+	if result.Rep == depot.RepNotAllowed {
+		tunnelConn.Close()
+		return nil, result, fmt.Errorf("local: %w", depot.ErrNotAllowed)
 	}
-	password := string(buf[0:plen])
-	dbgLog.Println("password:", password)
-
-	if username != config.UserName || password != config.Password {
-		_, err = conn.Write([]byte{0x01, 0x01})
-		return errAuth
+	if result.Rep != depot.RepSucceeded {
+		tunnelConn.Close()
+		return nil, result, errors.New("local: " + result.Error)
 	}
-	_, err = conn.Write([]byte{0x01, 0x00})
-	return nil
+	return tunnelConn, result, nil
 }
 
-/*
-client:
-   +----+-----+-------+------+----------+----------+
-   |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
-   +----+-----+-------+------+----------+----------+
-   | 1  |  1  | X'00' |  1   | Variable |    2     |
-   +----+-----+-------+------+----------+----------+
-
-server:
-   +----+-----+-------+------+----------+----------+
-   |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
-   +----+-----+-------+------+----------+----------+
-   | 1  |  1  | X'00' |  1   | Variable |    2     |
-   +----+-----+-------+------+----------+----------+
-*/
-func getSocksRequest(conn net.Conn) (addrReq *depot.AddrReq, err error) {
-	buf := make([]byte, 263)
-	var n int
-	depot.SetReadTimeout(conn)
-	// read till we get possible domain length field
-	if n, err = io.ReadAtLeast(conn, buf, DOMAIN_LEN+1); err != nil {
-		return
-	}
-	dbgLog.Printf("read %v bytes\n", buf[0:n])
-
-	if buf[VER] != socksVer5 {
-		err = errVer
-		return
-	}
-
-	if buf[CMD] != socksCmdConnect { // only support CONNECT reqeust now
-		err = errCmd
-		return
-	}
+// waitTunnel sends the open request via control connection and waits for the
+// tunnel connection from local.
+func waitTunnel(ctrlConn net.Conn, open *depot.Open) (net.Conn, error) {
+	ch := addPending(open.ID)
+	defer removePending(open.ID, ch)
 
-	msgLen := -1
-	switch buf[ATYP] {
-	case ATYP_IPV4:
-		msgLen = 6 + net.IPv4len
-	case ATYP_IPV6:
-		msgLen = 6 + net.IPv6len
-	case ATYP_DOMAIN:
-		msgLen = 7 + int(buf[DOMAIN_LEN])
-	default:
-		err = errAddrType
-		return
+	if err := depot.WriteMsg(ctrlConn, depot.MsgOpen, open); err != nil {
+		return nil, err
 	}
 
-	if n < msgLen {
-		if _, err = io.ReadFull(conn, buf[n:msgLen]); err != nil {
-			return
-		}
-	} else if n > msgLen {
-		err = errReqExtraData
-		return
+	// wait for local's connection on tunnel port
+	select {
+	case tunnelConn := <-ch:
+		dbgLog.Println("get new tunnel connection:", tunnelConn.RemoteAddr(),
+			"for", open.ID)
+		return tunnelConn, nil
+	case <-time.After(tunnelWaitTimeout):
+		return nil, errors.New("wait tunnel timeout")
 	}
+}
 
-	addrReq, err = depot.NewReqAddr(buf[ATYP:msgLen])
+// getStreamTunnel opens a stream and sends the open request on it, local then
+// connects the stream to the app.
+func getStreamTunnel(session *depot.Session, open *depot.Open) (net.Conn, error) {
+	stream, err := session.Open()
 	if err != nil {
-		return
-	}
-
-	// Sending connection established message immediately to client.
-	// This some round trip time for creating socks connection with the client.
-	// But if connection failed, the client will get connection reset error.
-	reply := []byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08, 0x43}
-	if _, err = conn.Write(reply); err != nil {
-		clog.Error("send connection confirmation:", err)
-		return
+		return nil, err
 	}
+	dbgLog.Println("open new stream:", stream.ID(), "for", open.ID)
 
-	return
-}
-
-// getTunnel sends request address to local and waits for local's new tunnel
-// connection, shakes hand with it.
-func getTunnel(ctrlConn net.Conn, addrReq *depot.AddrReq) (net.Conn, error) {
-	// send socks reqeust to local via control connection
-	if _, err := ctrlConn.Write(addrReq.Raw); err != nil {
+	if err := depot.WriteMsg(stream, depot.MsgOpen, open); err != nil {
+		stream.Close()
 		return nil, err
 	}
+	return stream, nil
+}
 
-	// wait for local's connection on tunnel port
-	tunnelConn := <-ctrlInfo.tunnelChan
-	dbgLog.Println("get new tunnel connection:", tunnelConn.RemoteAddr())
+// socksReplier sends the reply of socks5 code rep in the client's version.
+type socksReplier func(conn net.Conn, rep byte, bind []byte) error
 
-	// receive and check the socksraw handshake msg
-	// FIXME: If there are many new tunnels, socksraw may not match
-	buf := make([]byte, 256)
-	n, err := io.ReadAtLeast(tunnelConn, buf, 5)
-	if err != nil {
-		return nil, err
-	}
-	dbgLog.Println("receive handshake of local:", buf[0:n])
+// peekedConn reads the bytes peeked from the connection first.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
 
-	if !bytes.Equal(buf[0:n], addrReq.Raw) {
-		return nil, errors.New("socksraw does not match")
-	}
-	return tunnelConn, nil
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
 }
 
-func handleSocks5Conn(socksConn net.Conn) (err error) {
-	dbgLog.Printf("socks connect from %s\n", socksConn.RemoteAddr().String())
+// handleSocksConn serves a socks5 or socks4 client. If bound is not empty,
+// the session goes to the agent with this name.
+func handleSocksConn(conn net.Conn, bound string) (err error) {
+	dbgLog.Printf("socks connect from %s\n", conn.RemoteAddr().String())
 
 	closed := false
 	defer func() {
 		if !closed {
-			socksConn.Close()
+			conn.Close()
 		}
 	}()
 
-	if err = socksHandShake(socksConn); err != nil {
-		clog.Error("socks handshake: ", err)
+	var ver [1]byte
+	depot.SetReadTimeout(conn)
+	if _, err = io.ReadFull(conn, ver[:]); err != nil {
 		return
 	}
-
-	if err = socksAuthticate(socksConn); err != nil {
-		clog.Error("socks authticate:", err)
+	socksConn := &peekedConn{conn, io.MultiReader(bytes.NewReader(ver[:]), conn)}
+
+	var user string
+	var cmd byte
+	var addrReq *depot.AddrReq
+	var reply socksReplier
+	proto := "socks5"
+	switch ver[0] {
+	case socksVer5:
+		user, cmd, addrReq, err = depot.Socks5Request(socksConn,
+			getTargetMethod(), checkUser)
+		if err != nil {
+			clog.Error(err)
+			handshakeFailures.inc(authFailureReason(err, "socks_handshake"))
+		}
+		reply = depot.SendSocksReply
+	case socksVer4:
+		user, cmd, addrReq, err = socks4Request(socksConn)
+		if err != nil {
+			clog.Error(err)
+			handshakeFailures.inc(authFailureReason(err, "socks_handshake"))
+		}
+		reply = sendSocks4Reply
+		proto = "socks4"
+	default:
+		err = errors.New("socks version not supported")
+		clog.Error("socks handshake: ", err)
+		handshakeFailures.inc("socks_version")
+	}
+	if err != nil {
 		return
 	}
+	dbgLog.Println("request address:", addrReq)
 
-	addrReq, err := getSocksRequest(socksConn)
+	s := newSession(sessionKind(proto, cmd), conn.RemoteAddr(), user, addrReq)
+	defer func() { s.close(err) }()
+
+	a, addrReq, p, rep, err := routeRequest(bound, user, cmd, addrReq)
 	if err != nil {
-		clog.Error("error getting request:", err)
+		reply(socksConn, rep, nil)
 		return
 	}
-	dbgLog.Println("request address:", addrReq)
+	s.setAgent(a)
+	if err = s.admit(); err != nil {
+		reply(socksConn, depot.RepGeneralFailure, nil)
+		return
+	}
+
+	switch cmd {
+	case socksCmdUDP:
+		return handleUDPAssociate(socksConn, a, addrReq, p, s)
+	case socksCmdBind:
+		return handleBind(socksConn, a, addrReq, reply, s)
+	}
+
+	// Sending connection established message immediately to client saves
+	// some round trip time for creating socks connection with the client.
+	// But if connection failed, the client will get connection reset error.
+	optimistic := getConfig().OptimisticReply
+	if optimistic {
+		if err = reply(socksConn, depot.RepSucceeded, nil); err != nil {
+			clog.Error("send connection confirmation:", err)
+			return
+		}
+	}
 
 	// handle the request to local
-	tunnelConn, err := getTunnel(ctrlInfo.ctrlConn, addrReq)
+	tunnelConn, result, err := getTunnel(a, depot.CmdConnect, addrReq)
 	if err != nil {
-		clog.Error("Failed connect to local")
+		clog.Error("Failed connect to local:", err)
+		if !optimistic {
+			reply(socksConn, failureRep(result), nil)
+		}
 		return
 	}
+	tunnelConn = s.count(tunnelConn)
 	defer func() {
 		if !closed {
 			tunnelConn.Close()
 		}
 	}()
 
+	if !optimistic {
+		if err = reply(socksConn, depot.RepSucceeded, result.Bind); err != nil {
+			clog.Error("send connection confirmation:", err)
+			return
+		}
+	}
+
 	go depot.PipeThenClose(socksConn, tunnelConn)
 	depot.PipeThenClose(tunnelConn, socksConn)
 	closed = true
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+)
+
+// udpClient is the address of the socks client sending datagrams. It's
+// learned from the first datagram if the client did not tell it in the
+// request.
+type udpClient struct {
+	mu   sync.Mutex
+	ip   net.IP // expected ip, nil if any
+	addr *net.UDPAddr
+}
+
+// accept returns false if the datagram is not from the client.
+func (c *udpClient) accept(src *net.UDPAddr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.addr == nil {
+		if c.ip != nil && !c.ip.Equal(src.IP) {
+			return false
+		}
+		c.addr = src
+		return true
+	}
+	return c.addr.IP.Equal(src.IP) && c.addr.Port == src.Port
+}
+
+func (c *udpClient) get() *net.UDPAddr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addr
+}
+
+// handleUDPAssociate opens an UDP relay for the client and relays the
+// datagrams through a tunnel to the agent, until the socks connection or the
+// tunnel is closed. The destination of each datagram is checked with p, and
+// the datagrams are counted in s.
+func handleUDPAssociate(socksConn net.Conn, a *agent, addrReq *depot.AddrReq,
+	p *policy, s *session) error {
+	tunnelConn, result, err := getTunnel(a, depot.CmdUDP, addrReq)
+	if err != nil {
+		clog.Error("Failed connect to local:", err)
+		depot.SendSocksReply(socksConn, failureRep(result), nil)
+		return err
+	}
+	tunnelConn = s.count(tunnelConn)
+	defer tunnelConn.Close()
+
+	ip := socksConn.LocalAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		clog.Error("listen udp relay:", err)
+		depot.SendSocksReply(socksConn, depot.RepGeneralFailure, nil)
+		return err
+	}
+	defer relay.Close()
+
+	bind, err := depot.NewAddrReqFromAddr(relay.LocalAddr().String())
+	if err != nil {
+		depot.SendSocksReply(socksConn, depot.RepGeneralFailure, nil)
+		return err
+	}
+	if err = depot.SendSocksReply(socksConn, depot.RepSucceeded, bind.Raw); err != nil {
+		return err
+	}
+	dbgLog.Println("udp relay", relay.LocalAddr(), "for", socksConn.RemoteAddr())
+
+	client := &udpClient{}
+	if reqIP := net.ParseIP(addrReq.Host); reqIP != nil && !reqIP.IsUnspecified() {
+		client.ip = reqIP
+	}
+
+	go func() {
+		relayToClient(tunnelConn, relay, client)
+		socksConn.Close()
+	}()
+	go relayToTunnel(relay, tunnelConn, client, p)
+
+	// the association terminates when the socks connection is closed
+	socksConn.SetReadDeadline(time.Time{})
+	io.Copy(ioutil.Discard, socksConn)
+	dbgLog.Println("udp relay closed for", socksConn.RemoteAddr())
+	return nil
+}
+
+func relayToTunnel(relay *net.UDPConn, tunnelConn net.Conn, client *udpClient,
+	p *policy) {
+	buf := make([]byte, depot.MaxDatagram)
+	for {
+		n, src, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !client.accept(src) {
+			dbgLog.Println("drop datagram from", src)
+			continue
+		}
+		dst, _, err := depot.ParseUDPHeader(buf[:n])
+		if err == nil {
+			err = p.allowDest(dst)
+		}
+		if err != nil {
+			dbgLog.Println("drop datagram:", err)
+			continue
+		}
+		if err := depot.WriteDatagram(tunnelConn, buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func relayToClient(tunnelConn net.Conn, relay *net.UDPConn, client *udpClient) {
+	buf := make([]byte, depot.MaxDatagram)
+	for {
+		tunnelConn.SetReadDeadline(time.Time{}) // local closes idle tunnels
+		n, err := depot.ReadDatagram(tunnelConn, buf)
+		if err != nil {
+			return
+		}
+		if addr := client.get(); addr != nil {
+			relay.WriteToUDP(buf[:n], addr)
+		}
+	}
+}
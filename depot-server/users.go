@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The users file of server has the socks users, e.g.
+//
+//  {
+//      "users": [
+//          {"name": "alice", "hash": "$2a$10$...", "expires": "2026-12-31",
+//           "notes": "laptop"},
+//          {"name": "bob", "hash": "$2a$10$...", "enabled": false},
+//          {"name": "guest", "hash": "$2a$10$...", "policy": "guest"}
+//      ],
+//      "policies": {"guest": {...}}
+//  }
+//
+// -  hash: bcrypt hash of the password, printed by `depot-server -hash`.
+// -  enabled: false to revoke the user, true if omitted.
+// -  expires: the last day the user can log in, never expires if empty.
+// -  policy: name of the user's policy, see policy.go. No limits if empty.
+//
+// The file is loaded again when it's modified, a broken file is ignored and
+// the users loaded before are kept.
+
+const expiresLayout = "2006-01-02"
+
+var (
+	errUserDisabled = errors.New("socks user is disabled")
+	errUserExpired  = errors.New("socks user is expired")
+	// compared for unknown users, so they take as long as the others
+	dummyHash, _ = bcrypt.GenerateFromPassword([]byte("depot"), bcrypt.DefaultCost)
+)
+
+type user struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Enabled *bool     `json:"enabled"`
+	Expires string    `json:"expires"`
+	Notes   string    `json:"notes"`
+	Policy  string    `json:"policy"`
+	expires time.Time // the day after Expires
+	policy  *policy
+}
+
+type userDB struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	users   map[string]*user
+}
+
+var hashPassword bool // print hash instead of running server
+
+func loadUsers(path string) (map[string]*user, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Users    []*user                  `json:"users"`
+		Policies map[string]*policyConfig `json:"policies"`
+	}
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	policies := make(map[string]*policy)
+	for name, c := range file.Policies {
+		if policies[name], err = newPolicy(c); err != nil {
+			return nil, fmt.Errorf("%s: policy %s: %v", path, name, err)
+		}
+	}
+
+	m := make(map[string]*user)
+	for _, u := range file.Users {
+		if u.Name == "" || u.Hash == "" {
+			return nil, fmt.Errorf("%s: user without name or hash", path)
+		}
+		if _, ok := m[u.Name]; ok {
+			return nil, fmt.Errorf("%s: duplicate user %s", path, u.Name)
+		}
+		if u.Expires != "" {
+			t, err := time.ParseInLocation(expiresLayout, u.Expires, time.Local)
+			if err != nil {
+				return nil, fmt.Errorf("%s: user %s: %v", path, u.Name, err)
+			}
+			u.expires = t.AddDate(0, 0, 1)
+		}
+		if u.Policy != "" {
+			if u.policy = policies[u.Policy]; u.policy == nil {
+				return nil, fmt.Errorf("%s: user %s: no policy %s", path,
+					u.Name, u.Policy)
+			}
+		}
+		m[u.Name] = u
+	}
+	return m, nil
+}
+
+func newUserDB(path string) (*userDB, error) {
+	db := &userDB{path: path}
+	if err := db.reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// reload loads the file if it's modified since last time.
+func (db *userDB) reload() error {
+	fi, err := os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+	if db.users != nil && fi.ModTime().Equal(db.modTime) {
+		return nil
+	}
+
+	// a broken file is not loaded again until it's modified
+	db.modTime = fi.ModTime()
+	m, err := loadUsers(db.path)
+	if err != nil {
+		return err
+	}
+	db.users = m
+	clog.Printf("load %d users from %s\n", len(m), db.path)
+	return nil
+}
+
+func (db *userDB) get(name string) *user {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.reload(); err != nil {
+		clog.Error("reload users:", err)
+	}
+	return db.users[name]
+}
+
+// check authenticates the user by password.
+func (db *userDB) check(name, password string) error {
+	u := db.get(name)
+	if u == nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return depot.ErrSocksAuth
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.Hash), []byte(password)) != nil {
+		return depot.ErrSocksAuth
+	}
+	if u.Enabled != nil && !*u.Enabled {
+		return errUserDisabled
+	}
+	if !u.expires.IsZero() && !time.Now().Before(u.expires) {
+		return errUserExpired
+	}
+	return nil
+}
+
+// checkUser authenticates the socks user by the users file, or by the user
+// in the configuration if there is no users file.
+func checkUser(name, password string) error {
+	s := getSettings()
+	if s.users != nil {
+		return s.users.check(name, password)
+	}
+	if config := s.config; name != config.UserName || password != config.Password {
+		return depot.ErrSocksAuth
+	}
+	return nil
+}
+
+// userPolicy returns the policy of the socks user, nil if no limits.
+func userPolicy(name string) *policy {
+	users := getUsers()
+	if users == nil {
+		return nil
+	}
+	if u := users.get(name); u != nil {
+		return u.policy
+	}
+	return nil
+}
+
+// printHash reads a password from stdin and prints its hash for the users
+// file.
+func printHash() error {
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return errors.New("empty password")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(hash))
+	return nil
+}
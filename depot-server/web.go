@@ -1,50 +1,206 @@
 package main
 
 import (
+	"fmt"
 	"html/template"
 	"net"
 	"net/http"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/choueric/clog"
 	"github.com/choueric/depot"
 )
 
+type agentInfoT struct {
+	Name   string
+	Addr   string
+	Uptime string
+	Mux    bool
+	RTT    string
+}
+
+type sessionInfoT struct {
+	ID         uint64
+	Kind       string
+	Client     string
+	User       string
+	Target     string
+	Agent      string
+	Start      string
+	Duration   string
+	Up         string
+	Down       string
+	Throughput string
+	Limit      string
+	Reason     string
+}
+
+type limitInfoT struct {
+	Scope string
+	Name  string
+	Rate  string
+}
+
 type webInfoT struct {
-	Version    string
-	SocksPort  int
-	CtrlPort   int
-	CtrlAddr   string
-	TunnelHost string
-	dir        string
+	Version        string
+	SocksPort      int
+	CtrlPort       int
+	Agents         []agentInfoT
+	Sessions       []sessionInfoT
+	ClosedSessions []sessionInfoT
+	Limits         []limitInfoT
+	Admin          bool // limits can be changed
+	dir            string
 }
 
+// webInfo holds the fields which don't change while running.
 var webInfo webInfoT
 
 func initWebInfo() {
+	config := getConfig()
 	webInfo.Version = depot.VERSION
 	webInfo.SocksPort = config.ServerPort
 	webInfo.CtrlPort = config.ControlPort
 	webInfo.dir = depot.GetDefaultConfigDir()
 }
 
-func updateWebInfo() {
-	if ctrlInfo.ctrlConn != nil {
-		webInfo.CtrlAddr = ctrlInfo.ctrlConn.RemoteAddr().String()
-	} else {
-		webInfo.CtrlAddr = "No Connection"
+// formatBytes formats n bytes as "12.3 KiB".
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	div, exp := float64(unit), 0
+	for n/div >= unit && exp < 4 {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", n/div, "KMGTP"[exp])
+}
+
+func formatRate(rate int64) string {
+	if rate == 0 {
+		return "no limit"
 	}
+	return formatBytes(float64(rate)) + "/s"
+}
+
+func sessionInfo(st *sessionStat) sessionInfoT {
+	end := time.Now()
+	if st.End != nil {
+		end = *st.End
+	}
+	return sessionInfoT{
+		ID:       st.ID,
+		Kind:     st.Kind,
+		Client:   st.Client,
+		User:     st.User,
+		Target:   st.Target,
+		Agent:    st.Agent,
+		Start:    st.Start.Format("2006-01-02 15:04:05"),
+		Duration: end.Sub(st.Start).Truncate(time.Second).String(),
+		Up:       formatBytes(float64(st.Up)),
+		Down:     formatBytes(float64(st.Down)),
+		Throughput: formatBytes(st.RateUp) + "/s up, " +
+			formatBytes(st.RateDown) + "/s down",
+		Limit:  formatRate(st.RateLimit),
+		Reason: st.Reason,
+	}
+}
+
+// formatRTT formats the heartbeat round trip time, "-" if not measured.
+func formatRTT(rtt time.Duration) string {
+	if rtt == 0 {
+		return "-"
+	}
+	return rtt.Round(10 * time.Microsecond).String()
+}
+
+// newWebInfo returns the current status for a page. It's built for each
+// request, as requests are served concurrently.
+func newWebInfo() *webInfoT {
+	info := &webInfoT{
+		Version:   webInfo.Version,
+		SocksPort: webInfo.SocksPort,
+		CtrlPort:  webInfo.CtrlPort,
+		dir:       webInfo.dir,
+		Admin:     getConfig().WebAdmin != nil,
+	}
+	for _, a := range listAgents() {
+		info.Agents = append(info.Agents, agentInfoT{
+			Name:   a.name,
+			Addr:   a.ctrlConn.RemoteAddr().String(),
+			Uptime: a.uptime().Truncate(time.Second).String(),
+			Mux:    a.session != nil,
+			RTT:    formatRTT(a.getRTT()),
+		})
+	}
+
+	for _, st := range listSessions() {
+		info.Sessions = append(info.Sessions, sessionInfo(&st))
+	}
+	for _, st := range listClosedSessions() {
+		info.ClosedSessions = append(info.ClosedSessions, sessionInfo(&st))
+	}
+
+	c := currentLimits()
+	info.Limits = append(info.Limits,
+		limitInfoT{"global", "", formatRate(c.Global)},
+		limitInfoT{"session", "", formatRate(c.Session)})
+	for _, name := range sortedKeys(c.Users) {
+		info.Limits = append(info.Limits,
+			limitInfoT{"user", name, formatRate(c.Users[name])})
+	}
+	for _, name := range sortedKeys(c.Agents) {
+		info.Limits = append(info.Limits,
+			limitInfoT{"agent", name, formatRate(c.Agents[name])})
+	}
+	return info
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 func rootHandler(w http.ResponseWriter, r *http.Request) {
-	updateWebInfo()
+	info := newWebInfo()
 
-	file := filepath.Join(webInfo.dir, "root.html")
+	file := filepath.Join(info.dir, "root.html")
 	t, err := template.ParseFiles(file)
 	if err != nil {
 		clog.Fatal(err)
 	}
-	t.Execute(w, &webInfo)
+	t.Execute(w, info)
+}
+
+// limitHandler changes a rate limit by the form of the web page.
+func limitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if status, err := authWebAdmin(w, r); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	rate, err := parseRate(r.FormValue("rate"))
+	if err == nil {
+		err = setLimit(r.FormValue("scope"), strings.TrimSpace(r.FormValue("name")),
+			rate)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func serveWeb(host, webPort string) {
@@ -54,6 +210,9 @@ func serveWeb(host, webPort string) {
 	http.Handle("/css/", http.FileServer(http.Dir(webInfo.dir)))
 
 	http.HandleFunc("/", rootHandler)
+	http.HandleFunc(apiPrefix, apiHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/limit", limitHandler)
 
 	addr := net.JoinHostPort(host, webPort)
 	dbgLog.Printf("start listen web at %v ...\n", addr)
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/choueric/clog"
+	"github.com/choueric/depot"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The web port is read-only unless web_admin is configured, e.g.
+//
+//  "web_admin": {"user": "admin", "hash": "$2a$10$..."}
+//
+// Then the form of rate limits and the PUT requests of the API need the user
+// and password by HTTP basic authentication. As browsers send the saved
+// credentials with the requests of other sites too, requests from a browser
+// must come from the pages of the web port itself.
+
+var (
+	errWebReadOnly = errors.New("web port is read-only, set web_admin to change")
+	errWebAuth     = errors.New("wrong user or password")
+	errCrossOrigin = errors.New("cross-origin request")
+)
+
+// checkWebAdmin checks the configuration of web_admin, nil is valid.
+func checkWebAdmin(c *depot.WebAdminConfig) error {
+	if c == nil {
+		return nil
+	}
+	if c.User == "" {
+		return errors.New("empty user")
+	}
+	if _, err := bcrypt.Cost([]byte(c.Hash)); err != nil {
+		return errors.New("invalid hash")
+	}
+	return nil
+}
+
+// sameOrigin tells if the request is from the pages of the web port, by the
+// Origin or Referer which browsers send. Requests with neither are not from
+// browsers, e.g. curl, and are allowed.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Referer()
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// authWebAdmin authenticates the request which changes settings. It returns
+// the HTTP status and error to reply if it fails.
+func authWebAdmin(w http.ResponseWriter, r *http.Request) (int, error) {
+	admin := getConfig().WebAdmin
+	if admin == nil {
+		return http.StatusForbidden, errWebReadOnly
+	}
+	if !sameOrigin(r) {
+		return http.StatusForbidden, errCrossOrigin
+	}
+	name, password, ok := r.BasicAuth()
+	if ok {
+		// both are compared so that a wrong user takes as long as a wrong
+		// password
+		userOK := subtle.ConstantTimeCompare([]byte(name), []byte(admin.User)) == 1
+		err := bcrypt.CompareHashAndPassword([]byte(admin.Hash), []byte(password))
+		if userOK && err == nil {
+			return http.StatusOK, nil
+		}
+		clog.Warn("web: authentication of", name, "from", r.RemoteAddr, "failed")
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="depot"`)
+	return http.StatusUnauthorized, errWebAuth
+}
@@ -0,0 +1,122 @@
+package depot
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHeartbeatInterval is the interval of PING if not configured.
+	DefaultHeartbeatInterval = 2 * time.Second
+	// DefaultHeartbeatMisses is how many PINGs in a row can be without PONG
+	// before the peer is dead, if not configured.
+	DefaultHeartbeatMisses = 3
+)
+
+var ErrPeerDead = errors.New("peer missed heartbeats")
+
+// Heartbeat sends PING on the control connection, and measures the round
+// trip time by the PONG of the same sequence number. The peer is dead if too
+// many PINGs in a row have no PONG, even when TCP can't tell, e.g. on a
+// half-open path.
+type Heartbeat struct {
+	mu     sync.Mutex
+	seq    uint32
+	sent   time.Time // of the last PING
+	acked  uint32    // the last seq answered by PONG
+	rtt    time.Duration
+	misses int // PINGs without PONG in a row
+}
+
+// Ping returns the next PING, which carries the last RTT to the peer.
+func (h *Heartbeat) Ping() *Ping {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.seq != h.acked {
+		h.misses++
+	}
+	h.seq++
+	h.sent = time.Now()
+	return &Ping{Seq: h.seq, RTT: int64(h.rtt / time.Microsecond)}
+}
+
+// Pong handles the PONG from the peer. A late PONG still shows the peer is
+// alive, but only the PONG of the last PING measures the RTT.
+func (h *Heartbeat) Pong(p *Ping) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if p.Seq == 0 || p.Seq > h.seq || p.Seq <= h.acked {
+		return
+	}
+	if p.Seq == h.seq {
+		h.rtt = time.Since(h.sent)
+	}
+	h.acked = p.Seq
+	h.misses = 0
+}
+
+// RTT returns the last round trip time, 0 if not measured yet.
+func (h *Heartbeat) RTT() time.Duration {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rtt
+}
+
+// Misses returns the number of PINGs without PONG in a row.
+func (h *Heartbeat) Misses() int {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.misses
+}
+
+// Run sends PING to conn every interval() until done is closed. It returns
+// ErrPeerDead when there are misses() PINGs in a row without PONG, or the
+// error of writing. interval and misses are called for each PING, so they
+// can be changed while running.
+//
+// PINGs are written by another goroutine, so the peer is checked on time even
+// if writing blocks, e.g. when the peer stops reading. The caller should close
+// conn on ErrPeerDead, which ends the blocked writing.
+func (h *Heartbeat) Run(conn net.Conn, interval func() time.Duration,
+	misses func() int, done <-chan struct{}) error {
+	pings := make(chan *Ping, 1)
+	errc := make(chan error, 1)
+	defer close(pings)
+	go func() {
+		for p := range pings {
+			if err := WriteMsg(conn, MsgPing, p); err != nil {
+				errc <- err
+				for range pings {
+				}
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case err := <-errc:
+			return err
+		case <-time.After(interval()):
+		}
+		if h.Misses() >= misses() {
+			return ErrPeerDead
+		}
+		p := h.Ping()
+		select {
+		case pings <- p:
+		default:
+			// the last PING is not written yet, which Ping counts as missed
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package depot
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatPong(t *testing.T) {
+	var h Heartbeat
+	p1 := h.Ping()
+	p2 := h.Ping()
+	if h.Misses() != 1 {
+		t.Fatalf("misses = %d after 2 PINGs, want 1", h.Misses())
+	}
+
+	// a late PONG shows the peer is alive but doesn't measure the RTT
+	h.Pong(&Ping{Seq: p1.Seq})
+	if h.Misses() != 0 || h.RTT() != 0 {
+		t.Errorf("late PONG: misses = %d, rtt = %v", h.Misses(), h.RTT())
+	}
+	h.Pong(&Ping{Seq: p2.Seq})
+	if h.RTT() == 0 {
+		t.Error("RTT is not measured by the PONG of the last PING")
+	}
+
+	// PONGs of unknown or old sequences are ignored
+	h.Ping()
+	h.Ping()
+	for _, seq := range []uint32{0, p1.Seq, p2.Seq, 100} {
+		h.Pong(&Ping{Seq: seq})
+	}
+	if h.Misses() != 1 {
+		t.Errorf("misses = %d after invalid PONGs, want 1", h.Misses())
+	}
+}
+
+func TestHeartbeatBlockedWrite(t *testing.T) {
+	// nobody reads the other end, so writing the first PING blocks
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	var h Heartbeat
+	interval := func() time.Duration { return 10 * time.Millisecond }
+	misses := func() int { return 3 }
+	errc := make(chan error, 1)
+	go func() { errc <- h.Run(conn, interval, misses, nil) }()
+
+	select {
+	case err := <-errc:
+		if err != ErrPeerDead {
+			t.Errorf("Run() = %v, want %v", err, ErrPeerDead)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("peer isn't found dead while writing blocks")
+	}
+	conn.Close()
+}
+
+func TestHeartbeatDone(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	// the peer answers every PING
+	var h Heartbeat
+	go func() {
+		for {
+			var p Ping
+			if err := ExpectMsg(peer, MsgPing, &p); err != nil {
+				return
+			}
+			h.Pong(&p)
+		}
+	}()
+
+	done := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- h.Run(conn, func() time.Duration { return 5 * time.Millisecond },
+			func() int { return 2 }, done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(done)
+	if err := <-errc; err != nil {
+		t.Errorf("Run() = %v, want nil", err)
+	}
+	if h.RTT() == 0 {
+		t.Error("RTT is not measured")
+	}
+}
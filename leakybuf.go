@@ -1,11 +1,24 @@
 // Provides leaky buffer, based on the example in Effective Go.
 package depot
 
+import "sync/atomic"
+
 type LeakyBuf struct {
-	bufSize  int // size of each buffer
+	gets     uint64 // accessed atomically
+	misses   uint64 // gets without free buffer, accessed atomically
+	bufSize  int    // size of each buffer
 	freeList chan []byte
 }
 
+// LeakyBufStats is the usage of a leaky buffer.
+type LeakyBufStats struct {
+	Size   int    // size of each buffer
+	Cap    int    // max number of free buffers
+	Free   int    // number of free buffers
+	Gets   uint64 // number of buffers got
+	Misses uint64 // number of buffers created because none was free
+}
+
 const leakyBufSize = 4108 // data.len(2) + hmacsha1(10) + data(4096)
 const maxNBuf = 2048
 
@@ -22,9 +35,11 @@ func NewLeakyBuf(n, bufSize int) *LeakyBuf {
 
 // Get returns a buffer from the leaky buffer or create a new buffer.
 func (lb *LeakyBuf) Get() (b []byte) {
+	atomic.AddUint64(&lb.gets, 1)
 	select {
 	case b = <-lb.freeList:
 	default:
+		atomic.AddUint64(&lb.misses, 1)
 		b = make([]byte, lb.bufSize)
 	}
 	return
@@ -43,3 +58,19 @@ func (lb *LeakyBuf) Put(b []byte) {
 	}
 	return
 }
+
+// Stats returns the usage of the leaky buffer.
+func (lb *LeakyBuf) Stats() LeakyBufStats {
+	return LeakyBufStats{
+		Size:   lb.bufSize,
+		Cap:    cap(lb.freeList),
+		Free:   len(lb.freeList),
+		Gets:   atomic.LoadUint64(&lb.gets),
+		Misses: atomic.LoadUint64(&lb.misses),
+	}
+}
+
+// PipeBufStats returns the usage of the leaky buffer used by PipeThenClose.
+func PipeBufStats() LeakyBufStats {
+	return leakyBuf.Stats()
+}
@@ -1,8 +1,8 @@
 package depot
 
 import (
-	"io/ioutil"
 	"os"
+	"sync/atomic"
 
 	"github.com/choueric/clog"
 )
@@ -11,16 +11,32 @@ const (
 	logFlag = clog.Ldate | clog.Ltime | clog.Lshortfile | clog.Lcolor
 )
 
+// debugWriter writes to stderr only when debug is on, so debug logging can be
+// switched by reload without replacing the logger which goroutines use.
+type debugWriter struct {
+	on int32
+}
+
+func (w *debugWriter) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&w.on) == 0 {
+		return len(p), nil
+	}
+	return os.Stderr.Write(p)
+}
+
 var (
 	isDebug bool
-	dbgLog  = clog.New(ioutil.Discard, "", 0)
+	dbgOut  debugWriter
+	dbgLog  = clog.New(&dbgOut, "", logFlag)
 )
 
+// SetDebug switches debug logging on or off, and returns the debug logger,
+// which is always the same one.
 func SetDebug(d bool) *clog.Logger {
+	var on int32
 	if d {
-		dbgLog = clog.New(os.Stderr, "", logFlag)
-	} else {
-		dbgLog = clog.New(ioutil.Discard, "", 0)
+		on = 1
 	}
+	atomic.StoreInt32(&dbgOut.on, on)
 	return dbgLog
 }
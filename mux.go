@@ -0,0 +1,552 @@
+package depot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Multiplexer carrying many logical streams over one connection between
+// depot-server and depot-local.
+//
+//  frame:
+//  +------+-----------+--------+----------+
+//  | TYPE | STREAM ID | LENGTH | PAYLOAD  |
+//  +------+-----------+--------+----------+
+//  |  1   |     4     |   4    | Variable |
+//  +------+-----------+--------+----------+
+//
+// -  TYPE: frame type
+//    -  OPEN:   0x01, open a new stream, no payload
+//    -  DATA:   0x02, LENGTH bytes of stream data follow
+//    -  WINDOW: 0x03, LENGTH is the number of bytes the receiver consumed
+//    -  CLOSE:  0x04, sender will neither read nor write the stream anymore
+//    -  RESET:  0x05, abort the stream immediately
+// -  STREAM ID: streams opened by the dialing side (local) are odd, streams
+//    opened by the accepting side (server) are even. Stream 0 is the control
+//    stream, it's open on both sides once the session is created. OPEN with
+//    an ID of the receiver's parity is refused by RESET.
+// -  LENGTH: payload length, or window increment for WINDOW frames.
+//
+// Each stream has its own receive window. A sender never has more than
+// muxWindow unacknowledged bytes in flight for one stream, so a slow reader
+// only stalls its own stream instead of the whole connection.
+
+const (
+	frameOpen   = 0x01
+	frameData   = 0x02
+	frameWindow = 0x03
+	frameClose  = 0x04
+	frameReset  = 0x05
+
+	frameHeaderLen  = 9
+	maxFramePayload = 16 * 1024
+	muxWindow       = 256 * 1024
+	maxAcceptQueue  = 256
+)
+
+var (
+	errSessionClosed = errors.New("mux: session closed")
+	errStreamClosed  = errors.New("mux: stream closed")
+	errStreamReset   = errors.New("mux: stream reset by peer")
+	errAcceptQueue   = errors.New("mux: accept queue is full")
+	errResetQueue    = errors.New("mux: too many pending resets")
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "mux: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Session is a multiplexed connection. Both peers create a Session on the
+// same underlying connection, with isServer set on exactly one side.
+type Session struct {
+	conn     net.Conn
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	streams  map[uint32]*Stream
+	nextID   uint32
+	parity   uint32 // of the IDs of streams opened by this side
+	acceptCh chan *Stream
+	resetCh  chan uint32 // RESETs to send, written by resetLoop
+	ctrl     *Stream
+	die      chan struct{}
+	dieOnce  sync.Once
+}
+
+// NewSession starts multiplexing on conn.
+func NewSession(conn net.Conn, isServer bool) *Session {
+	s := &Session{
+		conn:     conn,
+		streams:  make(map[uint32]*Stream),
+		acceptCh: make(chan *Stream, maxAcceptQueue),
+		resetCh:  make(chan uint32, maxAcceptQueue),
+		die:      make(chan struct{}),
+	}
+	if isServer {
+		s.nextID = 2
+	} else {
+		s.nextID = 1
+	}
+	s.parity = s.nextID % 2
+	s.ctrl = newStream(s, 0)
+	s.streams[0] = s.ctrl
+	go s.recvLoop()
+	go s.resetLoop()
+	return s
+}
+
+// Control returns the control stream, which exists as long as the session.
+func (s *Session) Control() *Stream {
+	return s.ctrl
+}
+
+// Open creates a new stream and notifies the peer about it.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return nil, errSessionClosed
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameOpen, id, 0, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for a stream opened by the peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.die:
+		return nil, errSessionClosed
+	}
+}
+
+// Close closes the underlying connection and all streams.
+func (s *Session) Close() error {
+	var err error
+	s.dieOnce.Do(func() {
+		close(s.die)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+// CloseChan returns a channel which is closed when the session is down.
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.die
+}
+
+// NumStreams returns the number of opened streams, the control stream is not
+// counted.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams) - 1
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) getStream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) writeFrame(typ byte, id, length uint32, payload []byte) error {
+	var hdr [frameHeaderLen]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:5], id)
+	binary.BigEndian.PutUint32(hdr[5:9], length)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.isClosed() {
+		return errSessionClosed
+	}
+	if _, err := s.conn.Write(hdr[:]); err != nil {
+		s.Close()
+		return err
+	}
+	if len(payload) > 0 {
+		if _, err := s.conn.Write(payload); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// sendReset is used by recvLoop, which must not block on writing, so the
+// RESET is queued for resetLoop. A peer causing more RESETs than the queue
+// holds is not reading, and the session is closed.
+func (s *Session) sendReset(id uint32) {
+	select {
+	case s.resetCh <- id:
+	default:
+		dbgLog.Println(errResetQueue)
+		s.Close()
+	}
+}
+
+// resetLoop writes the queued RESETs in order.
+func (s *Session) resetLoop() {
+	for {
+		select {
+		case id := <-s.resetCh:
+			if s.writeFrame(frameReset, id, 0, nil) != nil {
+				return
+			}
+		case <-s.die:
+			return
+		}
+	}
+}
+
+func (s *Session) recvLoop() {
+	defer s.Close()
+	var hdr [frameHeaderLen]byte
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			dbgLog.Println("mux: read frame:", err)
+			return
+		}
+		typ := hdr[0]
+		id := binary.BigEndian.Uint32(hdr[1:5])
+		length := binary.BigEndian.Uint32(hdr[5:9])
+
+		switch typ {
+		case frameOpen:
+			if id != 0 && id%2 == s.parity {
+				dbgLog.Println("mux: peer opens stream", id, "of our parity")
+				s.sendReset(id)
+				continue
+			}
+			s.mu.Lock()
+			if _, ok := s.streams[id]; ok {
+				s.mu.Unlock()
+				dbgLog.Println("mux: duplicated stream", id)
+				return
+			}
+			st := newStream(s, id)
+			s.streams[id] = st
+			s.mu.Unlock()
+			select {
+			case s.acceptCh <- st:
+			default:
+				dbgLog.Println(errAcceptQueue)
+				s.removeStream(id)
+				s.sendReset(id)
+			}
+		case frameData:
+			if length > maxFramePayload {
+				dbgLog.Println("mux: frame too large:", length)
+				return
+			}
+			data := make([]byte, length)
+			if _, err := io.ReadFull(s.conn, data); err != nil {
+				dbgLog.Println("mux: read frame:", err)
+				return
+			}
+			if st := s.getStream(id); st != nil {
+				if !st.pushData(data) {
+					dbgLog.Println("mux: stream", id, "exceeds its window")
+					// removes it, and no more DATA of it is sent after the RESET
+					st.remoteReset()
+					s.sendReset(id)
+				}
+			} else {
+				s.sendReset(id)
+			}
+		case frameWindow:
+			if st := s.getStream(id); st != nil {
+				st.incrSendWindow(length)
+			}
+		case frameClose:
+			if st := s.getStream(id); st != nil {
+				st.remoteClose()
+			}
+		case frameReset:
+			if st := s.getStream(id); st != nil {
+				st.remoteReset()
+			}
+		default:
+			dbgLog.Println("mux: invalid frame type", typ)
+			return
+		}
+	}
+}
+
+// Stream is a logical connection in a Session. It implements net.Conn.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	writeMu       sync.Mutex // makes each Write atomic on the stream
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	consumed      int // bytes read but not acknowledged by WINDOW
+	sendWindow    int
+	localClosed   bool
+	remoteClosed  bool
+	reset         bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readCh        chan struct{}
+	writeCh       chan struct{}
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		sess:       s,
+		sendWindow: muxWindow,
+		readCh:     make(chan struct{}, 1),
+		writeCh:    make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// ID returns the stream's identifier in its session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return timeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return timeoutError{}
+	case <-st.sess.die:
+		return errSessionClosed
+	}
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(b)
+			st.consumed += n
+			delta := 0
+			if st.consumed >= muxWindow/2 && !st.remoteClosed {
+				delta = st.consumed
+				st.consumed = 0
+			}
+			st.mu.Unlock()
+			if delta > 0 {
+				st.sess.writeFrame(frameWindow, st.id, uint32(delta), nil)
+			}
+			return n, nil
+		}
+		var err error
+		switch {
+		case st.reset:
+			err = errStreamReset
+		case st.localClosed:
+			err = errStreamClosed
+		case st.remoteClosed:
+			err = io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if err = st.wait(st.readCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (n int, err error) {
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+	for len(b) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.reset:
+			err = errStreamReset
+		case st.localClosed:
+			err = errStreamClosed
+		case st.remoteClosed:
+			err = io.ErrClosedPipe
+		}
+		chunk := 0
+		if err == nil {
+			chunk = len(b)
+			if chunk > st.sendWindow {
+				chunk = st.sendWindow
+			}
+			if chunk > maxFramePayload {
+				chunk = maxFramePayload
+			}
+			st.sendWindow -= chunk
+		}
+		deadline := st.writeDeadline
+		st.mu.Unlock()
+		if err != nil {
+			return
+		}
+
+		if chunk == 0 {
+			if err = st.wait(st.writeCh, deadline); err != nil {
+				return
+			}
+			continue
+		}
+		if err = st.sess.writeFrame(frameData, st.id, uint32(chunk), b[:chunk]); err != nil {
+			return
+		}
+		n += chunk
+		b = b[chunk:]
+	}
+	return
+}
+
+// Close closes the stream in both directions and tells the peer.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	remote := st.remoteClosed
+	st.mu.Unlock()
+	notify(st.readCh)
+	notify(st.writeCh)
+
+	if remote {
+		st.sess.removeStream(st.id)
+	}
+	return st.sess.writeFrame(frameClose, st.id, 0, nil)
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readCh)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writeCh)
+	return nil
+}
+
+// pushData returns false if the peer sends more data than the window allows.
+func (st *Stream) pushData(data []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.localClosed {
+		return true // nobody will read it, just drop
+	}
+	if st.buf.Len()+st.consumed+len(data) > muxWindow {
+		st.reset = true
+		notify(st.readCh)
+		notify(st.writeCh)
+		return false
+	}
+	st.buf.Write(data)
+	notify(st.readCh)
+	return true
+}
+
+func (st *Stream) incrSendWindow(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += int(n)
+	st.mu.Unlock()
+	notify(st.writeCh)
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	local := st.localClosed
+	st.mu.Unlock()
+	notify(st.readCh)
+	notify(st.writeCh)
+	if local {
+		st.sess.removeStream(st.id)
+	}
+}
+
+func (st *Stream) remoteReset() {
+	st.mu.Lock()
+	st.reset = true
+	st.mu.Unlock()
+	notify(st.readCh)
+	notify(st.writeCh)
+	st.sess.removeStream(st.id)
+}
@@ -0,0 +1,254 @@
+package depot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newSessionPair returns the server and client sessions over a TCP
+// connection on loopback.
+func newSessionPair(t *testing.T) (*Session, *Session) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewSession(<-accepted, true)
+	client := NewSession(c, false)
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server, client
+}
+
+func openPair(t *testing.T, server, client *Session) (*Stream, *Stream) {
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ID() != peer.ID() || st.ID()%2 != 1 {
+		t.Fatalf("stream ids %d and %d", st.ID(), peer.ID())
+	}
+	return st, peer
+}
+
+func TestMuxReadWrite(t *testing.T) {
+	server, client := newSessionPair(t)
+	st, peer := openPair(t, server, client)
+
+	if _, err := st.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	if _, err := peer.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(st, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+
+	// the control stream works on both sides without Open
+	go WriteMsg(client.Control(), MsgPing, &Ping{Seq: 1})
+	var p Ping
+	if err := ExpectMsg(server.Control(), MsgPing, &p); err != nil || p.Seq != 1 {
+		t.Fatalf("control: %+v, %v", p, err)
+	}
+	if n := server.NumStreams(); n != 1 {
+		t.Errorf("NumStreams() = %d, want 1", n)
+	}
+}
+
+func TestMuxWindow(t *testing.T) {
+	server, client := newSessionPair(t)
+	st, peer := openPair(t, server, client)
+
+	// more than the window, so the writer needs WINDOW frames to finish
+	data := make([]byte, 4*muxWindow+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := st.Write(data)
+		st.Close()
+		errc <- err
+	}()
+
+	// the writer stalls while nobody reads
+	time.Sleep(50 * time.Millisecond)
+	st.mu.Lock()
+	window := st.sendWindow
+	st.mu.Unlock()
+	if window != 0 {
+		t.Errorf("send window = %d before reading, want 0", window)
+	}
+
+	got, err := io.ReadAll(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, different from the %d written", len(got), len(data))
+	}
+}
+
+func TestMuxClose(t *testing.T) {
+	server, client := newSessionPair(t)
+	st, peer := openPair(t, server, client)
+
+	st.Write([]byte("last"))
+	st.Close()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "last" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	if _, err := peer.Read(buf); err != io.EOF {
+		t.Fatalf("read after close = %v, want EOF", err)
+	}
+	if _, err := peer.Write(buf); err != io.ErrClosedPipe {
+		t.Errorf("write to closed peer = %v, want %v", err, io.ErrClosedPipe)
+	}
+	if _, err := st.Write(buf); err != errStreamClosed {
+		t.Errorf("write after close = %v, want %v", err, errStreamClosed)
+	}
+	peer.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for server.NumStreams()+client.NumStreams() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed streams are not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMuxReset(t *testing.T) {
+	server, client := newSessionPair(t)
+	st, peer := openPair(t, server, client)
+
+	if err := server.writeFrame(frameReset, peer.ID(), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	if _, err := st.Read(buf); err != errStreamReset {
+		t.Fatalf("read after reset = %v, want %v", err, errStreamReset)
+	}
+	if _, err := st.Write(buf); err != errStreamReset {
+		t.Fatalf("write after reset = %v, want %v", err, errStreamReset)
+	}
+}
+
+func TestMuxDeadline(t *testing.T) {
+	server, client := newSessionPair(t)
+	st, peer := openPair(t, server, client)
+
+	st.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	_, err := st.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("read = %v, want timeout", err)
+	}
+	if time.Since(start) < 15*time.Millisecond {
+		t.Error("read timed out too early")
+	}
+
+	// a timed out stream still works after the deadline is cleared
+	st.SetReadDeadline(time.Time{})
+	peer.Write([]byte("x"))
+	if _, err := st.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// writing stalls when the window is used up
+	st.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = st.Write(make([]byte, 2*muxWindow))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("write = %v, want timeout", err)
+	}
+}
+
+func TestMuxSessionClose(t *testing.T) {
+	server, client := newSessionPair(t)
+	st, _ := openPair(t, server, client)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := st.Read(make([]byte, 1))
+		done <- err
+	}()
+	server.Close()
+	select {
+	case err := <-done:
+		if err != errSessionClosed {
+			t.Fatalf("read = %v, want %v", err, errSessionClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read is not woken up by closing the session")
+	}
+	if _, err := client.Accept(); err != errSessionClosed {
+		t.Errorf("accept = %v, want %v", err, errSessionClosed)
+	}
+	if _, err := client.Open(); err != errSessionClosed {
+		t.Errorf("open = %v, want %v", err, errSessionClosed)
+	}
+}
+
+func TestMuxOpenParity(t *testing.T) {
+	conn, raw := net.Pipe()
+	server := NewSession(conn, true)
+	defer server.Close()
+	defer raw.Close()
+
+	writeHeader := func(typ byte, id uint32) {
+		var hdr [frameHeaderLen]byte
+		hdr[0] = typ
+		binary.BigEndian.PutUint32(hdr[1:5], id)
+		if _, err := raw.Write(hdr[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// stream 2 can only be opened by server
+	writeHeader(frameOpen, 2)
+	var hdr [frameHeaderLen]byte
+	raw.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(raw, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if hdr[0] != frameReset || binary.BigEndian.Uint32(hdr[1:5]) != 2 {
+		t.Errorf("reply to OPEN of stream 2 = %x, want RESET", hdr)
+	}
+
+	writeHeader(frameOpen, 3)
+	st, err := server.Accept()
+	if err != nil || st.ID() != 3 {
+		t.Fatalf("Accept() = %v, %v, want stream 3", st, err)
+	}
+	if n := server.NumStreams(); n != 1 {
+		t.Errorf("NumStreams() = %d, want 1", n)
+	}
+}
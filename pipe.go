@@ -2,12 +2,13 @@ package depot
 
 import (
 	"net"
+	"sync/atomic"
 	"time"
 )
 
 func SetReadTimeout(c net.Conn) {
-	if readTimeout != 0 {
-		c.SetReadDeadline(time.Now().Add(readTimeout))
+	if d := time.Duration(atomic.LoadInt64(&readTimeout)); d != 0 {
+		c.SetReadDeadline(time.Now().Add(d))
 	}
 }
 
@@ -0,0 +1,284 @@
+package depot
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Messages exchanged between server and local, on the control connection,
+// at the beginning of each tunnel connection and on each stream.
+//
+//  +------+--------+----------+
+//  | TYPE | LENGTH | PAYLOAD  |
+//  +------+--------+----------+
+//  |  1   |   2    | Variable |
+//  +------+--------+----------+
+//
+// -  TYPE: message type, see Msg* below.
+// -  LENGTH: length of payload.
+// -  PAYLOAD: JSON object of the message type. Unknown fields are ignored, so
+//    new fields can be added without breaking old peers.
+//
+// Local starts the control connection with HELLO. Server answers with
+// HELLO_ACK or with ERROR if it refuses the local.
+
+const (
+	// ProtoVersion must be the same on both sides. Bump it only for
+	// incompatible changes, use capabilities for the others.
+	ProtoVersion = 1
+
+	// CapMux means the control connection can be multiplexed.
+	CapMux = "mux"
+	// CapAuth means local wants server to authenticate itself.
+	CapAuth = "auth"
+	// CapReverse means server accepts streams opened by local, and connects
+	// for local's reverse socks clients.
+	CapReverse = "reverse"
+	// CapHeartbeat means local answers PING from server with PONG, so server
+	// can tell if local is dead.
+	CapHeartbeat = "heartbeat"
+)
+
+const (
+	MsgHello         = 0x01 // local -> server, Hello
+	MsgHelloAck      = 0x02 // server -> local, Hello
+	MsgOpen          = 0x03 // server -> local, Open
+	MsgOpenResult    = 0x04 // local -> server, OpenResult
+	MsgPing          = 0x05 // Ping
+	MsgPong          = 0x06 // Ping
+	MsgClose         = 0x07 // Close
+	MsgError         = 0x08 // Error
+	MsgTunnel        = 0x09 // local -> server, Tunnel, tunnel connection handshake
+	MsgChallenge     = 0x0a // server -> local, Challenge
+	MsgAuth          = 0x0b // local -> server, Auth
+	MsgForward       = 0x0c // local -> server, Forward
+	MsgForwardResult = 0x0d // server -> local, ForwardResult
+	MsgShutdown      = 0x0e // Shutdown
+)
+
+var msgNames = map[byte]string{
+	MsgHello:         "HELLO",
+	MsgHelloAck:      "HELLO_ACK",
+	MsgOpen:          "OPEN",
+	MsgOpenResult:    "OPEN_RESULT",
+	MsgPing:          "PING",
+	MsgPong:          "PONG",
+	MsgClose:         "CLOSE",
+	MsgError:         "ERROR",
+	MsgTunnel:        "TUNNEL",
+	MsgChallenge:     "CHALLENGE",
+	MsgAuth:          "AUTH",
+	MsgForward:       "FORWARD",
+	MsgForwardResult: "FORWARD_RESULT",
+	MsgShutdown:      "SHUTDOWN",
+}
+
+const maxMsgLen = 0xffff
+
+// commands of Open, same as socks5
+const (
+	CmdConnect = 0x01
+	CmdBind    = 0x02 // BIND, a second OpenResult reports the peer
+	CmdUDP     = 0x03 // UDP ASSOCIATE, datagrams on the tunnel, see udp.go
+)
+
+// reply codes of OpenResult, same as socks5
+const (
+	RepSucceeded           = 0x00
+	RepGeneralFailure      = 0x01
+	RepNotAllowed          = 0x02 // connection not allowed by ruleset
+	RepNetworkUnreachable  = 0x03
+	RepHostUnreachable     = 0x04
+	RepConnectionRefused   = 0x05
+	RepTTLExpired          = 0x06
+	RepCmdNotSupported     = 0x07
+	RepAddrTypeUnsupported = 0x08
+)
+
+// DefaultAgentName is used by locals which have no name.
+const DefaultAgentName = "default"
+
+type Hello struct {
+	Version int      `json:"version"`
+	Caps    []string `json:"caps"`
+	Name    string   `json:"name,omitempty"`  // agent name of local
+	Nonce   []byte   `json:"nonce,omitempty"` // local's nonce, see auth.go
+	Proof   []byte   `json:"proof,omitempty"` // server's MAC in HELLO_ACK
+}
+
+// HasCap checks if the peer has the capability.
+func (h *Hello) HasCap(c string) bool {
+	for _, cap := range h.Caps {
+		if cap == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Open asks local to open a tunnel to the address.
+type Open struct {
+	ID   uint32 `json:"id"`   // session ID
+	Cmd  byte   `json:"cmd"`  // Cmd*
+	Addr []byte `json:"addr"` // AddrReq.Raw
+}
+
+// OpenResult is sent on the tunnel after local tried to open it.
+type OpenResult struct {
+	ID    uint32 `json:"id"`
+	Rep   byte   `json:"rep"`            // Rep*
+	Bind  []byte `json:"bind,omitempty"` // AddrReq.Raw of the bound address
+	Error string `json:"error,omitempty"`
+}
+
+// DialErrorRep maps the error of dialing the app to a reply code.
+func DialErrorRep(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrNotAllowed):
+		return RepNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return RepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return RepNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return RepHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return RepTTLExpired
+	default:
+		return RepGeneralFailure
+	}
+}
+
+type Challenge struct {
+	Nonce []byte `json:"nonce"`
+}
+
+type Auth struct {
+	MAC []byte `json:"mac"`
+}
+
+// Ping is the heartbeat, the peer answers PONG with the same Ping. Both sides
+// send it, see heartbeat.go.
+type Ping struct {
+	Seq uint32 `json:"seq"`
+	RTT int64  `json:"rtt,omitempty"` // sender's last round trip time in microseconds
+}
+
+// Close tells the peer a session is closed. ID 0 means the control
+// connection itself.
+type Close struct {
+	ID     uint32 `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// Shutdown tells the peer it's shutting down. It takes no new sessions, and
+// the active ones are closed after Drain seconds. Old peers ignore it.
+type Shutdown struct {
+	Drain int `json:"drain"`
+}
+
+type Error struct {
+	Reason string `json:"reason"`
+}
+
+type Tunnel struct {
+	ID  uint32 `json:"id"`
+	MAC []byte `json:"mac,omitempty"` // TunnelMAC if shared_key is set
+}
+
+// Forward asks server to listen on Port for the life of the control
+// connection, and to open tunnels to Addr for its connections.
+type Forward struct {
+	Port int    `json:"port"`
+	Addr []byte `json:"addr"` // AddrReq.Raw
+}
+
+// ForwardResult tells local if server is listening for the Forward.
+type ForwardResult struct {
+	Port  int    `json:"port"`
+	Error string `json:"error,omitempty"`
+}
+
+type Msg struct {
+	Type    byte
+	Payload []byte
+}
+
+func MsgName(typ byte) string {
+	if name, ok := msgNames[typ]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", typ)
+}
+
+func (m *Msg) String() string {
+	return MsgName(m.Type) + " " + string(m.Payload)
+}
+
+func (m *Msg) Decode(v interface{}) error {
+	if err := json.Unmarshal(m.Payload, v); err != nil {
+		return fmt.Errorf("decode %s: %v", MsgName(m.Type), err)
+	}
+	return nil
+}
+
+// WriteMsg writes the whole message in one Write call, so it's safe to be
+// called by multiple goroutines on the same connection.
+func WriteMsg(w io.Writer, typ byte, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxMsgLen {
+		return errors.New("message too long")
+	}
+
+	buf := make([]byte, 3+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint16(buf[1:3], uint16(len(payload)))
+	copy(buf[3:], payload)
+	_, err = w.Write(buf)
+	return err
+}
+
+func ReadMsg(r io.Reader) (*Msg, error) {
+	var hdr [3]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	m := &Msg{
+		Type:    hdr[0],
+		Payload: make([]byte, binary.BigEndian.Uint16(hdr[1:3])),
+	}
+	if _, err := io.ReadFull(r, m.Payload); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ExpectMsg reads a message of type typ and decodes it into v. An ERROR
+// message from the peer is returned as error.
+func ExpectMsg(r io.Reader, typ byte, v interface{}) error {
+	m, err := ReadMsg(r)
+	if err != nil {
+		return err
+	}
+	if m.Type == MsgError {
+		var e Error
+		if err := m.Decode(&e); err != nil {
+			return err
+		}
+		return errors.New("peer error: " + e.Reason)
+	}
+	if m.Type != typ {
+		return fmt.Errorf("expect %s but get %s", MsgName(typ), MsgName(m.Type))
+	}
+	return m.Decode(v)
+}
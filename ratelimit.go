@@ -0,0 +1,100 @@
+package depot
+
+import (
+	"sync"
+	"time"
+)
+
+// maxWaitStep is the longest sleep of Wait, so a new rate applies soon.
+const maxWaitStep = 100 * time.Millisecond
+
+// RateLimiter is a token bucket of bytes, which can burst the bytes of one
+// second. Rate 0 means no limit, so does a nil RateLimiter.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64 // negative if bytes are taken in advance
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter of rate bytes per second, whose bucket is
+// full so that the first bytes can burst.
+func NewRateLimiter(rate int64) *RateLimiter {
+	l := &RateLimiter{last: time.Now()}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the rate, it applies to the waiting bytes too. A limit set
+// on a limiter without limit starts with a full bucket.
+func (l *RateLimiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	l.refill(time.Now())
+	if l.rate == 0 {
+		l.tokens = float64(rate)
+	}
+	l.rate = float64(rate)
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+}
+
+// Rate returns the rate in bytes per second, 0 if no limit.
+func (l *RateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+func (l *RateLimiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+}
+
+// Wait takes n bytes from the bucket, and blocks until they are paid.
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	l.mu.Unlock()
+
+	for {
+		l.mu.Lock()
+		if l.rate == 0 {
+			l.tokens = 0
+			l.mu.Unlock()
+			return
+		}
+		l.refill(time.Now())
+		if l.tokens >= 0 {
+			l.mu.Unlock()
+			return
+		}
+		d := time.Duration(-l.tokens / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		if d > maxWaitStep {
+			d = maxWaitStep
+		}
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,86 @@
+package depot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	var none *RateLimiter
+	for _, l := range []*RateLimiter{none, NewRateLimiter(0), NewRateLimiter(-5)} {
+		start := time.Now()
+		l.Wait(1 << 30)
+		if time.Since(start) > 10*time.Millisecond {
+			t.Errorf("limiter of rate %d blocks", l.Rate())
+		}
+		if l.Rate() != 0 {
+			t.Errorf("Rate() = %d, want 0", l.Rate())
+		}
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	tests := []struct {
+		rate    int64
+		waits   []int
+		min     time.Duration
+		max     time.Duration
+		comment string
+	}{
+		{1000, []int{1000}, 0, 20 * time.Millisecond, "burst of one second"},
+		{1000, []int{1000, 200}, 150 * time.Millisecond, 400 * time.Millisecond,
+			"over the burst"},
+		{1000, []int{1300}, 250 * time.Millisecond, 500 * time.Millisecond,
+			"tokens taken in advance"},
+		{10000, []int{0, -1}, 0, 20 * time.Millisecond, "nothing to wait"},
+	}
+	for _, tt := range tests {
+		l := NewRateLimiter(tt.rate)
+		start := time.Now()
+		for _, n := range tt.waits {
+			l.Wait(n)
+		}
+		if d := time.Since(start); d < tt.min || d > tt.max {
+			t.Errorf("%s: waited %v, want %v-%v", tt.comment, d, tt.min, tt.max)
+		}
+	}
+}
+
+func TestRateLimiterRefillCap(t *testing.T) {
+	l := NewRateLimiter(1000)
+	l.mu.Lock()
+	l.tokens = 0
+	l.refill(l.last.Add(10 * time.Second))
+	tokens := l.tokens
+	l.mu.Unlock()
+	if tokens != 1000 {
+		t.Errorf("tokens after a long idle = %v, want the burst 1000", tokens)
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	l := NewRateLimiter(100)
+	l.Wait(100)
+	done := make(chan struct{})
+	go func() {
+		l.Wait(10000) // about 100 seconds at the old rate
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// removing the limit releases the waiter, and forgives the debt
+	l.SetRate(0)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waiter is not released by SetRate(0)")
+	}
+	// a new limit starts with a full bucket
+	l.SetRate(100)
+	l.mu.Lock()
+	tokens := l.tokens
+	l.mu.Unlock()
+	if tokens != 100 {
+		t.Errorf("tokens = %v after the limit is set again, want 100", tokens)
+	}
+}
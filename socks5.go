@@ -0,0 +1,267 @@
+package depot
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// The socks5 protocol of server's socks port and local's reverse socks port.
+
+const (
+	socksVer5 = 5
+
+	VER             = 0
+	NMETHODS        = 1
+	METHODS         = 2
+	ULEN            = 1
+	UNAME           = 2
+	METHOD_NONE     = 0x00
+	METHOD_GSSAPI   = 0x01
+	METHOD_USERNAME = 0x02
+	METHOD_IANA     = 0x03 // 0x03 - 0x7f
+	METHOD_RSV      = 0x80 // 0x80 - 0xfe, reserve for private methods
+	METHOD_DENY     = 0xff // no acceptable methods
+	CMD             = 1
+	ATYP            = 3 // address type index
+	DST_ADDR        = 4 // ip addres start index
+	DOMAIN_LEN      = 4 // domain address length index
+	DOMAIN_ADDR     = 5 // domain address start index
+	ATYP_IPV4       = 1 // type is ipv4 address
+	ATYP_DOMAIN     = 3 // type is domain address
+	ATYP_IPV6       = 4 // type is ipv6 address
+)
+
+var (
+	errVer           = errors.New("socks version not supported")
+	errMethod        = errors.New("socks only support user/password method now")
+	errAuthExtraData = errors.New("socks authentication get extra data")
+	ErrSocksAuth     = errors.New("socks invalid username/password")
+	errReqExtraData  = errors.New("socks request get extra data")
+	ErrSocksCmd      = errors.New("socks command not supported")
+	errAddrType      = errors.New("socks invalid address type")
+)
+
+/*
+client:
+  +----+----------+----------+
+  |VER | NMETHODS | METHODS  |
+  +----+----------+----------+
+  | 1  |    1     | 1 to 255 |
+  +----+----------+----------+
+server:
+  +----+--------+
+  |VER | METHOD |
+  +----+--------+
+  | 1  |   1    |
+  +----+--------+
+*/
+func SocksHandShake(conn net.Conn, targetMethod int) (m int, err error) {
+	buf := make([]byte, 258)
+	SetReadTimeout(conn)
+
+	var n int
+	// make sure we get the nmethod field
+	if n, err = io.ReadAtLeast(conn, buf, NMETHODS+1); err != nil {
+		return
+	}
+	dbgLog.Printf("read %v bytes\n", buf[0:n])
+
+	if buf[VER] != socksVer5 {
+		return METHOD_DENY, errVer
+	}
+
+	nmethod := int(buf[NMETHODS])
+	msgLen := nmethod + 2
+	if n == msgLen { // done, common case
+		// do nothing, jump directly to send confirmation
+	} else if n < msgLen { // has more methods to read, rare case
+		if _, err = io.ReadFull(conn, buf[n:msgLen]); err != nil {
+			return
+		}
+	} else { // error, should not get extra data
+		return METHOD_DENY, errAuthExtraData
+	}
+
+	m = METHOD_DENY
+	for i := METHODS; i < msgLen; i++ {
+		if int(buf[i]) == targetMethod {
+			m = targetMethod
+			break
+		}
+	}
+
+	// send confirmation: version 5,
+	_, err = conn.Write([]byte{socksVer5, byte(m)})
+	if m == METHOD_DENY {
+		// authentication dosen't match
+		return m, errMethod
+	}
+	return m, err
+}
+
+/*
+user/password sub-authentication
++----+------+----------+------+----------+
+|VER | ULEN |   UNAME  | PLEN |  PASSWD  |
++----+------+----------+------+----------+
+| 1  |   1  | 1 to 255 |  1   | 1 to 255 |
++----+------+----------+------+----------+
+
++----+--------+
+|VER | STATUS |
++----+--------+
+| 1  |    1   |
++----+--------+
+
+VER: 0x01
+STATUS: 0x00, sucess. others, fail
+*/
+func SocksAuthenticate(conn net.Conn,
+	check func(username, password string) error) (username string, err error) {
+	buf := make([]byte, 257) // 255 + 2
+	SetReadTimeout(conn)
+
+	if _, err = io.ReadFull(conn, buf[0:2]); err != nil {
+		return
+	}
+
+	if buf[VER] != 0x01 {
+		err = errors.New("user/password sub-auth: invalid version")
+		return
+	}
+
+	ulen := int(buf[ULEN])
+	if _, err = io.ReadFull(conn, buf[0:ulen]); err != nil {
+		return
+	}
+	username = string(buf[0:ulen])
+	dbgLog.Println("username:", username)
+
+	if _, err = io.ReadFull(conn, buf[0:1]); err != nil {
+		return
+	}
+	plen := int(buf[0])
+	if _, err = io.ReadFull(conn, buf[0:plen]); err != nil {
+		return
+	}
+	password := string(buf[0:plen])
+
+	if err = check(username, password); err != nil {
+		conn.Write([]byte{0x01, 0x01})
+		return
+	}
+	_, err = conn.Write([]byte{0x01, 0x00})
+	return username, nil
+}
+
+/*
+client:
+   +----+-----+-------+------+----------+----------+
+   |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+   +----+-----+-------+------+----------+----------+
+   | 1  |  1  | X'00' |  1   | Variable |    2     |
+   +----+-----+-------+------+----------+----------+
+
+server:
+   +----+-----+-------+------+----------+----------+
+   |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+   +----+-----+-------+------+----------+----------+
+   | 1  |  1  | X'00' |  1   | Variable |    2     |
+   +----+-----+-------+------+----------+----------+
+*/
+func GetSocksRequest(conn net.Conn) (cmd byte, addrReq *AddrReq, err error) {
+	buf := make([]byte, 263)
+	var n int
+	SetReadTimeout(conn)
+	// read till we get possible domain length field
+	if n, err = io.ReadAtLeast(conn, buf, DOMAIN_LEN+1); err != nil {
+		return
+	}
+	dbgLog.Printf("read %v bytes\n", buf[0:n])
+
+	if buf[VER] != socksVer5 {
+		err = errVer
+		return
+	}
+
+	cmd = buf[CMD]
+	if cmd != CmdConnect && cmd != CmdBind && cmd != CmdUDP {
+		err = ErrSocksCmd
+		SendSocksReply(conn, RepCmdNotSupported, nil)
+		return
+	}
+
+	msgLen := -1
+	switch buf[ATYP] {
+	case ATYP_IPV4:
+		msgLen = 6 + net.IPv4len
+	case ATYP_IPV6:
+		msgLen = 6 + net.IPv6len
+	case ATYP_DOMAIN:
+		msgLen = 7 + int(buf[DOMAIN_LEN])
+	default:
+		err = errAddrType
+		SendSocksReply(conn, RepAddrTypeUnsupported, nil)
+		return
+	}
+
+	if n < msgLen {
+		if _, err = io.ReadFull(conn, buf[n:msgLen]); err != nil {
+			return
+		}
+	} else if n > msgLen {
+		err = errReqExtraData
+		return
+	}
+
+	fixPortEndian(buf[msgLen-2 : msgLen])
+	addrReq, err = NewReqAddr(buf[ATYP:msgLen])
+	return
+}
+
+// fixPortEndian fixes the port of transmission remote's endianess bug, in
+// the requests of socks5 clients only.
+func fixPortEndian(port []byte) {
+	switch binary.BigEndian.Uint16(port) {
+	case 33571, 50111: // 33571=0x8323, 0x2383=9091
+		port[0], port[1] = port[1], port[0]
+	}
+}
+
+// SendSocksReply sends the reply of request with the bound address, which is
+// AddrReq.Raw. If bind is nil, 0.0.0.0:0 is used.
+func SendSocksReply(conn net.Conn, rep byte, bind []byte) error {
+	if bind == nil {
+		bind = []byte{ATYP_IPV4, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	}
+	reply := append([]byte{socksVer5, rep, 0x00}, bind...)
+	_, err := conn.Write(reply)
+	return err
+}
+
+// Socks5Request authenticates the socks5 client by targetMethod and check,
+// and reads its request.
+func Socks5Request(conn net.Conn, targetMethod int,
+	check func(username, password string) error) (user string, cmd byte,
+	addrReq *AddrReq, err error) {
+	method, err := SocksHandShake(conn, targetMethod)
+	if err != nil {
+		err = fmt.Errorf("socks handshake: %w", err)
+		return
+	}
+
+	if method == METHOD_USERNAME {
+		if user, err = SocksAuthenticate(conn, check); err != nil {
+			err = fmt.Errorf("socks authenticate %s: %w", user, err)
+			return
+		}
+	}
+
+	if cmd, addrReq, err = GetSocksRequest(conn); err != nil {
+		err = fmt.Errorf("socks request: %w", err)
+	}
+	return
+}
@@ -0,0 +1,152 @@
+package depot
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// Control and tunnel connections are protected by mutually authenticated TLS.
+// Each side presents tls_cert/tls_key and authenticates the peer's
+// certificate by the private CA in tls_ca, by the SHA-256 fingerprints in
+// tls_pins, or by both. Unencrypted connections are only used if plaintext
+// is set explicitly.
+
+const tlsDialTimeout = 10 * time.Second
+
+var errNoTLS = errors.New("tls_cert and tls_key are not configured, " +
+	"set plaintext to true to allow unencrypted connections")
+
+// ServerTLSConfig returns the TLS configuration for the control and tunnel
+// listeners of server, nil if plaintext is allowed.
+func (c *Config) ServerTLSConfig() (*tls.Config, error) {
+	if c.Plaintext {
+		return nil, nil
+	}
+	tc, err := c.baseTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	tc.ClientAuth = tls.RequireAnyClientCert
+	tc.VerifyPeerCertificate = c.peerVerifier(x509.ExtKeyUsageClientAuth, "")
+	return tc, nil
+}
+
+// ClientTLSConfig returns the TLS configuration for local to connect server,
+// nil if plaintext is allowed.
+func (c *Config) ClientTLSConfig() (*tls.Config, error) {
+	if c.Plaintext {
+		return nil, nil
+	}
+	tc, err := c.baseTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	// the server certificate is verified by peerVerifier instead, which also
+	// knows about pins.
+	tc.InsecureSkipVerify = true
+	tc.VerifyPeerCertificate = c.peerVerifier(x509.ExtKeyUsageServerAuth,
+		c.ServerAddr)
+	return tc, nil
+}
+
+func (c *Config) baseTLSConfig() (*tls.Config, error) {
+	if c.TLSCert == "" || c.TLSKey == "" {
+		return nil, errNoTLS
+	}
+	if c.TLSCA == "" && len(c.TLSPins) == 0 {
+		return nil, errors.New("tls_ca or tls_pins is needed to authenticate the peer")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func (c *Config) loadCA() (*x509.CertPool, error) {
+	if c.TLSCA == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(c.TLSCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate in " + c.TLSCA)
+	}
+	return pool, nil
+}
+
+// CertFingerprint returns the hex SHA-256 of a DER certificate, the format
+// of tls_pins.
+func CertFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizePin(pin string) string {
+	return strings.ToLower(strings.Replace(pin, ":", "", -1))
+}
+
+// peerVerifier checks the peer certificate against the CA and the pins. The
+// CA is loaded for each connection so a new CA file works without restart.
+func (c *Config) peerVerifier(usage x509.ExtKeyUsage,
+	host string) func([][]byte, [][]*x509.Certificate) error {
+	pins := make(map[string]bool)
+	for _, pin := range c.TLSPins {
+		pins[normalizePin(pin)] = true
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("tls: peer has no certificate")
+		}
+		if len(pins) != 0 && !pins[CertFingerprint(rawCerts[0])] {
+			return errors.New("tls: peer certificate " +
+				CertFingerprint(rawCerts[0]) + " is not pinned")
+		}
+
+		pool, err := c.loadCA()
+		if err != nil || pool == nil {
+			return err
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			if certs[i], err = x509.ParseCertificate(raw); err != nil {
+				return err
+			}
+		}
+		opts := x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{usage},
+			DNSName:       host,
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err = certs[0].Verify(opts)
+		return err
+	}
+}
+
+// Dial connects to server, with TLS if tc is not nil.
+func Dial(addr string, tc *tls.Config) (net.Conn, error) {
+	if tc == nil {
+		return net.Dial("tcp", addr)
+	}
+	dialer := &net.Dialer{Timeout: tlsDialTimeout}
+	return tls.DialWithDialer(dialer, "tcp", addr, tc)
+}
@@ -0,0 +1,92 @@
+package depot
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// UDP datagrams of socks5 UDP ASSOCIATE are carried on the tunnel as:
+//  +--------+-----+------+------+----------+----------+----------+
+//  | LENGTH | RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+//  +--------+-----+------+------+----------+----------+----------+
+//  |   2    |  2  |  1   |  1   | Variable |    2     | Variable |
+//  +--------+-----+------+------+----------+----------+----------+
+//
+// -  LENGTH: length of the rest, which is the datagram of socks5 client
+//    with its UDP request header. From local to server, the address is the
+//    source of the datagram instead of the destination.
+
+const MaxDatagram = 65535
+
+var (
+	errFragment = errors.New("udp: fragmentation is not supported")
+	// ErrDatagramTooLong is the error of writing a datagram over MaxDatagram.
+	ErrDatagramTooLong = errors.New("udp: datagram too long")
+)
+
+// UDPHeader returns the socks5 UDP request header of the address.
+func UDPHeader(addr *AddrReq) []byte {
+	return append([]byte{0x00, 0x00, 0x00}, addr.Raw...)
+}
+
+// ParseUDPHeader returns the address and the data of a socks5 datagram.
+func ParseUDPHeader(b []byte) (*AddrReq, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, errors.New("udp: datagram too short")
+	}
+	if b[2] != 0x00 {
+		return nil, nil, errFragment
+	}
+
+	var n int
+	switch b[3] {
+	case 0x01:
+		n = 4 + net.IPv4len + 2
+	case 0x04:
+		n = 4 + net.IPv6len + 2
+	case 0x03:
+		if len(b) < 5 {
+			return nil, nil, errors.New("udp: datagram too short")
+		}
+		n = 5 + int(b[4]) + 2
+	default:
+		return nil, nil, errors.New("udp: invalid atype")
+	}
+	if len(b) < n {
+		return nil, nil, errors.New("udp: datagram too short")
+	}
+
+	addr, err := NewReqAddr(b[3:n])
+	if err != nil {
+		return nil, nil, err
+	}
+	return addr, b[n:], nil
+}
+
+// WriteDatagram writes a datagram with its header in one Write call.
+func WriteDatagram(w io.Writer, b []byte) error {
+	if len(b) > MaxDatagram {
+		return ErrDatagramTooLong
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadDatagram reads a datagram into buf, which should have MaxDatagram
+// bytes.
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(l[:]))
+	if n > len(buf) {
+		return 0, errors.New("udp: buffer too small")
+	}
+	return io.ReadFull(r, buf[:n])
+}